@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// Rejection reasons, also used as metric keys.
+const (
+	rejectDenied     = "denied"
+	rejectNotAllowed = "not_allowed"
+	rejectIPLimit    = "ip_limit"
+	rejectFull       = "max_connections"
+)
+
+// admission decides whether a new connection on a listener is accepted, based
+// on the service allow/deny lists and the connection caps.
+type admission struct {
+	allow    []netip.Prefix
+	deny     []netip.Prefix
+	limit    int // Per source IP
+	maxConns int // Whole service
+
+	mu     sync.Mutex
+	active int
+	perIP  map[netip.Addr]int
+}
+
+func newAdmission(service ServiceConfig) (*admission, error) {
+	a := &admission{
+		limit:    service.MaxConnsPerIP,
+		maxConns: service.MaxConnections,
+		perIP:    map[netip.Addr]int{},
+	}
+	var err error
+	if a.allow, err = parsePrefixes(service.Allow); err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	if a.deny, err = parsePrefixes(service.Deny); err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	return a, nil
+}
+
+// parsePrefixes accepts CIDR blocks as well as single addresses.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit returns a release func to call when the connection closes, or the
+// rejection reason. Deny entries win over allow entries; an empty allow list
+// admits every address that is not denied. Addresses that are not TCP, which
+// the lists cannot be checked against, are not allowed when there are lists.
+func (a *admission) admit(remote net.Addr) (release func(), reason string) {
+	var addr netip.Addr
+	if tcpAddr, ok := remote.(*net.TCPAddr); ok {
+		addr = tcpAddr.AddrPort().Addr().Unmap()
+		if containsAddr(a.deny, addr) {
+			return nil, rejectDenied
+		}
+		if len(a.allow) > 0 && !containsAddr(a.allow, addr) {
+			return nil, rejectNotAllowed
+		}
+	} else if len(a.allow) > 0 || len(a.deny) > 0 {
+		return nil, rejectNotAllowed
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.maxConns > 0 && a.active >= a.maxConns {
+		return nil, rejectFull
+	}
+	countIP := a.limit > 0 && addr.IsValid()
+	if countIP && a.perIP[addr] >= a.limit {
+		return nil, rejectIPLimit
+	}
+	a.active++
+	if countIP {
+		a.perIP[addr]++
+	}
+
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.active--
+		if countIP {
+			if a.perIP[addr]--; a.perIP[addr] <= 0 {
+				delete(a.perIP, addr)
+			}
+		}
+	}, ""
+}
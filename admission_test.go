@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func tcpAddr(ip string) *net.TCPAddr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func TestAdmit(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		service ServiceConfig
+		remote  net.Addr
+		want    string
+	}{
+		{"no lists", ServiceConfig{}, tcpAddr("203.0.113.7"), ""},
+		{"allowed", ServiceConfig{Allow: []string{"10.0.0.0/8"}}, tcpAddr("10.1.2.3"), ""},
+		{"not allowed", ServiceConfig{Allow: []string{"10.0.0.0/8"}}, tcpAddr("192.168.1.1"), rejectNotAllowed},
+		{"denied", ServiceConfig{Deny: []string{"192.168.1.1"}}, tcpAddr("192.168.1.1"), rejectDenied},
+		{"deny wins over allow", ServiceConfig{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.9.0.0/16"}}, tcpAddr("10.9.1.1"), rejectDenied},
+		{"ipv4-mapped allowed", ServiceConfig{Allow: []string{"10.0.0.0/8"}}, tcpAddr("::ffff:10.1.2.3"), ""},
+		{"ipv4-mapped denied", ServiceConfig{Deny: []string{"10.1.2.3"}}, tcpAddr("::ffff:10.1.2.3"), rejectDenied},
+		{"ipv6 allowed", ServiceConfig{Allow: []string{"fd00::/8"}}, tcpAddr("fd00::5"), ""},
+		{"not tcp without lists", ServiceConfig{}, &net.UnixAddr{Name: "@agent", Net: "unix"}, ""},
+		{"not tcp with allow list", ServiceConfig{Allow: []string{"10.0.0.0/8"}}, &net.UnixAddr{Name: "@agent", Net: "unix"}, rejectNotAllowed},
+		{"not tcp with deny list", ServiceConfig{Deny: []string{"10.0.0.0/8"}}, &net.UnixAddr{Name: "@agent", Net: "unix"}, rejectNotAllowed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := newAdmission(tt.service)
+			if err != nil {
+				t.Fatal(err)
+			}
+			release, reason := a.admit(tt.remote)
+			if reason != tt.want {
+				t.Fatalf("reason %q, want %q", reason, tt.want)
+			}
+			if (release != nil) != (reason == "") {
+				t.Errorf("release %v with reason %q", release != nil, reason)
+			}
+		})
+	}
+}
+
+func TestAdmitLimits(t *testing.T) {
+	a, err := newAdmission(ServiceConfig{MaxConnsPerIP: 2, MaxConnections: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := tcpAddr("10.0.0.1"), tcpAddr("::ffff:10.0.0.2")
+	var releases []func()
+	for i, tt := range []struct {
+		remote net.Addr
+		want   string
+	}{
+		{first, ""},
+		{first, ""},
+		{first, rejectIPLimit},
+		{second, ""},
+		{second, rejectFull}, // Below its own limit, but the service is full
+	} {
+		release, reason := a.admit(tt.remote)
+		if reason != tt.want {
+			t.Fatalf("admit %d from %s: reason %q, want %q", i, tt.remote, reason, tt.want)
+		}
+		if release != nil {
+			releases = append(releases, release)
+		}
+	}
+
+	// Closing one of the first address' connections makes room for it again
+	releases[0]()
+	if a.active != 2 || a.perIP[netip.MustParseAddr("10.0.0.1")] != 1 {
+		t.Errorf("after release: active %d, per IP %v", a.active, a.perIP)
+	}
+	release, reason := a.admit(first)
+	if reason != "" {
+		t.Fatalf("after release: %q", reason)
+	}
+	for _, release := range append(releases[1:], release) {
+		release()
+	}
+	if a.active != 0 || len(a.perIP) != 0 {
+		t.Errorf("all released: active %d, per IP %v", a.active, a.perIP)
+	}
+}
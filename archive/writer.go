@@ -0,0 +1,222 @@
+// Package archive records every raw frame received and every ACK sent to
+// rotating, gzip compressed JSON-lines files, as an evidentiary record of what
+// was exchanged with panels and receivers.
+package archive
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxSize = 64 << 20
+	defaultMaxAge  = 24 * time.Hour
+	flushInterval  = time.Second
+
+	filePrefix = "frames-"
+	fileSuffix = ".jsonl.gz"
+)
+
+// Directions of a record.
+const (
+	Received = "rx"
+	Sent     = "tx"
+)
+
+// Record is one archived frame.
+type Record struct {
+	Time      time.Time `json:"time"`
+	Service   string    `json:"service"`
+	Type      string    `json:"type"` // Service type, selects the parser on replay
+	ConnId    uint64    `json:"connId"`
+	Remote    string    `json:"remote"`
+	Direction string    `json:"direction"`
+	Frame     []byte    `json:"frame"`   // Exact bytes without the delimiter, base64 in JSON
+	Outcome   string    `json:"outcome"` // rx: parsed, unparsed, no_signal, rejected, refused, error, too_large, timeout; tx: ack, nak
+}
+
+type Config struct {
+	Dir     string        `yaml:"dir"`     // Archiving is off when empty
+	MaxSize int64         `yaml:"maxSize"` // Uncompressed bytes per file, default 64 MiB
+	MaxAge  time.Duration `yaml:"maxAge"`  // Rotate after this long, default 24h
+	Keep    int           `yaml:"keep"`    // Files to keep, 0 keeps all
+}
+
+// Writer appends records from any goroutine. Records go through a channel to a
+// single goroutine owning the file, which flushes every second so at most the
+// last second is lost on a crash.
+type Writer struct {
+	config  Config
+	records chan Record
+	done    chan error
+
+	mu     sync.RWMutex // Held for reading while sending on records
+	closed bool
+
+	file    *os.File
+	gz      *gzip.Writer
+	opened  time.Time
+	written int64
+}
+
+func NewWriter(config Config) (*Writer, error) {
+	if config.MaxSize <= 0 {
+		config.MaxSize = defaultMaxSize
+	}
+	if config.MaxAge <= 0 {
+		config.MaxAge = defaultMaxAge
+	}
+	if err := os.MkdirAll(config.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("creating archive directory: %w", err)
+	}
+
+	w := &Writer{
+		config:  config,
+		records: make(chan Record, 1024),
+		done:    make(chan error, 1),
+	}
+	if err := w.rotate(time.Now()); err != nil {
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// Write queues a record. It blocks rather than dropping when the writer falls
+// behind, because a missing record defeats the purpose of the archive. Records
+// written after Close, by connections still winding down, are dropped.
+func (w *Writer) Write(record Record) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return
+	}
+	w.records <- record
+}
+
+// Close flushes pending records and closes the current file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.records)
+	w.mu.Unlock()
+	return <-w.done
+}
+
+func (w *Writer) run() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case record, ok := <-w.records:
+			if !ok {
+				w.done <- w.closeFile()
+				return
+			}
+			if err := w.append(record); err != nil {
+				fmt.Printf("Error archiving frame: %v\n", err)
+			}
+		case <-ticker.C:
+			if w.gz == nil {
+				continue
+			}
+			if err := w.gz.Flush(); err != nil {
+				fmt.Printf("Error flushing frame archive: %v\n", err)
+			}
+		}
+	}
+}
+
+func (w *Writer) append(record Record) error {
+	if w.file == nil || w.written >= w.config.MaxSize || time.Since(w.opened) >= w.config.MaxAge {
+		if err := w.rotate(time.Now()); err != nil {
+			return err
+		}
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	n, err := w.gz.Write(append(line, '\n'))
+	w.written += int64(n)
+	return err
+}
+
+func (w *Writer) rotate(now time.Time) error {
+	if err := w.closeFile(); err != nil {
+		fmt.Printf("Error closing archive file: %v\n", err)
+	}
+
+	name := filepath.Join(w.config.Dir, filePrefix+now.UTC().Format("20060102T150405.000")+fileSuffix)
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("opening archive file: %w", err)
+	}
+	w.file = file
+	w.gz = gzip.NewWriter(file)
+	w.opened = now
+	w.written = 0
+
+	w.prune()
+	return nil
+}
+
+func (w *Writer) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	gzErr := w.gz.Close()
+	err := w.file.Close()
+	w.file, w.gz = nil, nil
+	if gzErr != nil {
+		return gzErr
+	}
+	return err
+}
+
+// prune removes the oldest files beyond Keep. File names sort by time.
+func (w *Writer) prune() {
+	if w.config.Keep <= 0 {
+		return
+	}
+	files, err := Files(w.config.Dir)
+	if err != nil {
+		fmt.Printf("Error listing archive files: %v\n", err)
+		return
+	}
+	for len(files) > w.config.Keep {
+		if err := os.Remove(files[0]); err != nil {
+			fmt.Printf("Error removing archive file: %v\n", err)
+		}
+		files = files[1:]
+	}
+}
+
+// Files returns the archive files in dir, oldest first.
+func Files(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasPrefix(name, filePrefix) && strings.HasSuffix(name, fileSuffix) {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,50 @@
+package archive
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteAfterClose(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Connections keep writing while the writer is closed under them
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				w.Write(Record{Time: time.Now(), Service: "Surguard", Direction: Received, Frame: []byte("frame"), Outcome: "parsed"})
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	w.Write(Record{Service: "late"})
+	if err := w.Close(); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+
+	files, err := Files(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("files %v, %v", files, err)
+	}
+	err = ReadFile(files[0], func(record Record) error {
+		if record.Service != "Surguard" || string(record.Frame) != "frame" {
+			t.Errorf("record %+v", record)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
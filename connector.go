@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultDialTimeout = 10 * time.Second
+	defaultBackoffMin  = 1 * time.Second
+	defaultBackoffMax  = 60 * time.Second
+
+	// A connection that stayed up this long resets the backoff
+	stableConnection = 30 * time.Second
+)
+
+// BackoffConfig controls the delay between reconnect rounds of a connect service.
+type BackoffConfig struct {
+	Min time.Duration `yaml:"min"` // First delay, doubled after every failed round
+	Max time.Duration `yaml:"max"` // Upper bound for the delay
+}
+
+// TLSConfig enables TLS on a listen or connect service.
+type TLSConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	CertFile string `yaml:"certFile"` // Our certificate: server certificate for listeners, client certificate for connectors
+	KeyFile  string `yaml:"keyFile"`  // Key for CertFile
+
+	// Connect services only
+	CAFile             string `yaml:"caFile"`             // PEM bundle used to verify the remote receiver, system pool when empty
+	ServerName         string `yaml:"serverName"`         // Overrides the name checked against the receiver certificate
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"` // Only for lab receivers with self-signed certificates
+
+	// Listen services only
+	ClientCAFile      string              `yaml:"clientCAFile"`      // Enables client certificate verification (mTLS)
+	RequireClientCert bool                `yaml:"requireClientCert"` // Refuse clients without a valid certificate
+	ClientAccounts    map[string][]string `yaml:"clientAccounts"`    // Certificate CN -> accounts it may report, "*" allows any
+}
+
+// connectorTargets returns the host:port addresses tried in order, primary first.
+// Hosts without a port use the service port; an empty list keeps the old
+// localhost behaviour.
+func connectorTargets(service ServiceConfig) []string {
+	if len(service.Hosts) == 0 {
+		return []string{net.JoinHostPort("localhost", strconv.Itoa(service.Port))}
+	}
+
+	targets := make([]string, 0, len(service.Hosts))
+	for _, host := range service.Hosts {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, strconv.Itoa(service.Port))
+		}
+		targets = append(targets, host)
+	}
+	return targets
+}
+
+// backoffDelay returns the wait before reconnect round n (starting at 0):
+// exponential growth capped at Max, with jitter so many agents
+// restarting together do not hammer a receiver in lockstep.
+func backoffDelay(cfg BackoffConfig, n int) time.Duration {
+	min, max := cfg.Min, cfg.Max
+	if min <= 0 {
+		min = defaultBackoffMin
+	}
+	if max < min {
+		max = defaultBackoffMax
+		if max < min {
+			max = min
+		}
+	}
+
+	delay := max
+	if n < 32 && min<<uint(n) > 0 && min<<uint(n) < max {
+		delay = min << uint(n)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func clientTLSConfig(service ServiceConfig, addr string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         service.TLS.ServerName,
+		InsecureSkipVerify: service.TLS.InsecureSkipVerify,
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ServerName = host
+	}
+
+	if service.TLS.CAFile != "" {
+		pem, err := os.ReadFile(service.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", service.TLS.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if service.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(service.TLS.CertFile, service.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// dialService opens one connection to addr, including the TLS handshake and
+// the optional login string.
+func dialService(service ServiceConfig, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   service.DialTimeout,
+		KeepAlive: service.KeepAlive,
+	}
+	if dialer.Timeout <= 0 {
+		dialer.Timeout = defaultDialTimeout
+	}
+
+	var conn net.Conn
+	var err error
+	if service.TLS.Enabled {
+		tlsConfig, cfgErr := clientTLSConfig(service, addr)
+		if cfgErr != nil {
+			return nil, cfgErr
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if service.Login != "" {
+		conn.SetWriteDeadline(time.Now().Add(dialer.Timeout))
+		if _, err := conn.Write([]byte(service.Login)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("sending login: %w", err)
+		}
+		conn.SetWriteDeadline(time.Time{})
+	}
+	return conn, nil
+}
+
+func startConnector(service ServiceConfig) {
+	targets := connectorTargets(service)
+	round := 0
+
+	for {
+		for _, addr := range targets {
+			conn, err := dialService(service, addr)
+			if err != nil {
+				fmt.Printf("Error connecting to service %s at %s: %v\n", service.Name, addr, err)
+				continue
+			}
+			fmt.Printf("Connected to service %s at %s\n", service.Name, addr)
+			connectedAt := time.Now()
+
+			handleConnection(conn, service)
+
+			fmt.Printf("Disconnected from service %s at %s, attempting to reconnect...\n", service.Name, addr)
+			if time.Since(connectedAt) >= stableConnection {
+				round = 0
+			}
+			// Start over from the primary so we fail back once it recovers
+			break
+		}
+
+		delay := backoffDelay(service.Backoff, round)
+		round++
+		fmt.Printf("Reconnecting to service %s in %s\n", service.Name, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+}
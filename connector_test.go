@@ -0,0 +1,60 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestConnectorTargets(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		hosts []string
+		want  []string
+	}{
+		{"default", nil, []string{"localhost:1025"}},
+		{"service port", []string{"primary.example", "10.0.0.2"}, []string{"primary.example:1025", "10.0.0.2:1025"}},
+		{"own port", []string{"primary.example:2000", "backup.example"}, []string{"primary.example:2000", "backup.example:1025"}},
+		{"ipv6", []string{"fd00::1", "[fd00::2]:2000"}, []string{"[fd00::1]:1025", "[fd00::2]:2000"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := connectorTargets(ServiceConfig{Port: 1025, Hosts: tt.hosts})
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		cfg    BackoffConfig
+		round  int
+		wantLo time.Duration
+		wantHi time.Duration
+	}{
+		{"defaults first round", BackoffConfig{}, 0, 500 * time.Millisecond, time.Second},
+		{"defaults doubled", BackoffConfig{}, 3, 4 * time.Second, 8 * time.Second},
+		{"defaults capped", BackoffConfig{}, 10, 30 * time.Second, 60 * time.Second},
+		{"shift overflow", BackoffConfig{}, 1000, 30 * time.Second, 60 * time.Second},
+		{"configured", BackoffConfig{Min: 2 * time.Second, Max: 5 * time.Second}, 1, 2 * time.Second, 4 * time.Second},
+		{"configured capped", BackoffConfig{Min: 2 * time.Second, Max: 5 * time.Second}, 2, 2500 * time.Millisecond, 5 * time.Second},
+		{"max below min", BackoffConfig{Min: 2 * time.Second, Max: time.Second}, 10, 30 * time.Second, 60 * time.Second},
+		{"min above default max", BackoffConfig{Min: 90 * time.Second}, 0, 45 * time.Second, 90 * time.Second},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := map[time.Duration]bool{}
+			for i := 0; i < 200; i++ {
+				delay := backoffDelay(tt.cfg, tt.round)
+				if delay < tt.wantLo || delay > tt.wantHi {
+					t.Fatalf("delay %s outside [%s, %s]", delay, tt.wantLo, tt.wantHi)
+				}
+				seen[delay] = true
+			}
+			if len(seen) < 2 {
+				t.Errorf("no jitter, always %v", seen)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	defaultMaxFrameSize = 4096
+	defaultFrameTimeout = 30 * time.Second
+	defaultWriteTimeout = 10 * time.Second
+)
+
+// Reasons a connection is closed, also used as metric keys.
+const (
+	closeEOF            = "eof"
+	closeIdle           = "idle_timeout"
+	closeFrameTimeout   = "frame_timeout"
+	closeFrameTooLarge  = "frame_too_large"
+	closeReadError      = "read_error"
+	closeWriteError     = "write_error"
+	closeClientRefused  = "client_refused"
+	closeAccountRefused = "account_refused"
+)
+
+var (
+	errIdleTimeout   = errors.New("no data within idle timeout")
+	errFrameTimeout  = errors.New("frame not completed within frame timeout")
+	errFrameTooLarge = errors.New("frame exceeds maximum size")
+)
+
+// frameReader splits a connection into EndChar delimited frames. It enforces
+// the service limits so a peer that stays silent, or trickles bytes without
+// ever sending the delimiter, cannot hold the goroutine and buffer forever.
+type frameReader struct {
+	conn         net.Conn
+	r            *bufio.Reader
+	endChar      byte
+	maxSize      int
+	idleTimeout  time.Duration // 0 waits forever for the first byte of a frame
+	frameTimeout time.Duration // From the first byte to EndChar, <= 0 lets a started frame take forever
+}
+
+func newFrameReader(conn net.Conn, service ServiceConfig) *frameReader {
+	f := &frameReader{
+		conn:         conn,
+		r:            bufio.NewReader(conn),
+		endChar:      service.EndChar,
+		maxSize:      service.MaxFrameSize,
+		idleTimeout:  service.IdleTimeout,
+		frameTimeout: service.FrameTimeout,
+	}
+	if f.maxSize <= 0 {
+		f.maxSize = defaultMaxFrameSize
+	}
+	if f.frameTimeout == 0 {
+		f.frameTimeout = defaultFrameTimeout
+	}
+	return f
+}
+
+// next returns the next frame without its delimiter. Empty frames are returned
+// as well; callers skip them. A frame cut off by the frame timeout or the size
+// limit is returned along with the error, so it can still be archived.
+func (f *frameReader) next() ([]byte, error) {
+	var frame []byte
+	var started time.Time
+
+	for {
+		// Deadlines only matter when the next byte has to come from the network
+		if f.r.Buffered() == 0 {
+			f.conn.SetReadDeadline(f.deadline(len(frame) > 0, started))
+		}
+
+		b, err := f.r.ReadByte()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if len(frame) > 0 {
+					return frame, errFrameTimeout
+				}
+				return nil, errIdleTimeout
+			}
+			return nil, err
+		}
+
+		if b == f.endChar {
+			return frame, nil
+		}
+		if len(frame) == 0 {
+			started = time.Now()
+		}
+		if len(frame) >= f.maxSize {
+			return frame, errFrameTooLarge
+		}
+		frame = append(frame, b)
+	}
+}
+
+func (f *frameReader) deadline(inFrame bool, started time.Time) time.Time {
+	var deadline time.Time
+	if f.idleTimeout > 0 {
+		deadline = time.Now().Add(f.idleTimeout)
+	}
+	if inFrame && f.frameTimeout > 0 {
+		if frameDeadline := started.Add(f.frameTimeout); deadline.IsZero() || frameDeadline.Before(deadline) {
+			deadline = frameDeadline
+		}
+	}
+	return deadline
+}
+
+// closeReason maps a frame read error to the metric key it is counted under.
+func closeReason(err error) string {
+	switch {
+	case errors.Is(err, io.EOF):
+		return closeEOF
+	case errors.Is(err, errIdleTimeout):
+		return closeIdle
+	case errors.Is(err, errFrameTimeout):
+		return closeFrameTimeout
+	case errors.Is(err, errFrameTooLarge):
+		return closeFrameTooLarge
+	}
+	return closeReadError
+}
+
+// writeTimeout bounds each ACK write, so a peer that stops reading cannot
+// hold the goroutine either.
+func writeTimeout(service ServiceConfig) time.Duration {
+	if service.WriteTimeout <= 0 {
+		return defaultWriteTimeout
+	}
+	return service.WriteTimeout
+}
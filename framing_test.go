@@ -0,0 +1,220 @@
+package main
+
+import (
+	"agent/archive"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// readerConn is a net.Conn serving a fixed byte stream.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readerConn) Read(p []byte) (int, error)      { return c.r.Read(p) }
+func (c readerConn) SetReadDeadline(time.Time) error { return nil }
+func (c readerConn) RemoteAddr() net.Addr            { return &net.TCPAddr{} }
+
+func FuzzFrameReader(f *testing.F) {
+	f.Add([]byte("501001 181234E13001003\x14"), byte(0x14), 16)
+	f.Add([]byte("\x14\x14abc\x14def"), byte(0x14), 4)
+	f.Add([]byte("99820040\"NULL\"0000R15L1#21401[]\r\n\n"), byte('\n'), 4096)
+
+	f.Fuzz(func(t *testing.T, stream []byte, endChar byte, maxSize int) {
+		service := ServiceConfig{EndChar: endChar, MaxFrameSize: maxSize % 8192}
+		frames := newFrameReader(readerConn{r: bytes.NewReader(stream)}, service)
+
+		var got [][]byte
+		for {
+			frame, err := frames.next()
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, errFrameTooLarge) {
+					t.Fatalf("unexpected error %v", err)
+				}
+				break
+			}
+			if len(frame) > frames.maxSize {
+				t.Fatalf("frame of %d bytes exceeds %d", len(frame), frames.maxSize)
+			}
+			if bytes.IndexByte(frame, endChar) >= 0 {
+				t.Fatalf("frame %q contains the delimiter", frame)
+			}
+			got = append(got, frame)
+		}
+
+		// Complete frames come back exactly as they were sent
+		want := bytes.Split(stream, []byte{endChar})
+		want = want[:len(want)-1]
+		for i, frame := range got {
+			if !bytes.Equal(frame, want[i]) {
+				t.Fatalf("frame %d = %q, want %q", i, frame, want[i])
+			}
+		}
+	})
+}
+
+func TestFrameReaderLimits(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		service ServiceConfig
+		send    string
+		frames  []string
+		err     error
+		reason  string
+	}{
+		{"frames then eof", ServiceConfig{EndChar: '\n'}, "abc\n\ndef\n", []string{"abc", "", "def"}, io.EOF, closeEOF},
+		{"idle timeout", ServiceConfig{EndChar: '\n', IdleTimeout: 30 * time.Millisecond}, "abc\n", []string{"abc"}, errIdleTimeout, closeIdle},
+		{"frame timeout", ServiceConfig{EndChar: '\n', FrameTimeout: 30 * time.Millisecond}, "abc\nde", []string{"abc"}, errFrameTimeout, closeFrameTimeout},
+		{"frame timeout before idle", ServiceConfig{EndChar: '\n', IdleTimeout: time.Hour, FrameTimeout: 30 * time.Millisecond}, "de", nil, errFrameTimeout, closeFrameTimeout},
+		{"too large", ServiceConfig{EndChar: '\n', MaxFrameSize: 4}, "abcd\nabcde\n", []string{"abcd"}, errFrameTooLarge, closeFrameTooLarge},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write([]byte(tt.send))
+				if tt.err == io.EOF {
+					client.Close()
+				}
+			}()
+			defer client.Close()
+
+			frames := newFrameReader(server, tt.service)
+			var got []string
+			var err error
+			for {
+				var frame []byte
+				if frame, err = frames.next(); err != nil {
+					break
+				}
+				got = append(got, string(frame))
+			}
+			if !slices.Equal(got, tt.frames) {
+				t.Errorf("frames %q, want %q", got, tt.frames)
+			}
+			if !errors.Is(err, tt.err) || closeReason(err) != tt.reason {
+				t.Errorf("error %v (%s), want %v (%s)", err, closeReason(err), tt.err, tt.reason)
+			}
+		})
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	for err, want := range map[error]string{
+		io.EOF:                                 closeEOF,
+		errIdleTimeout:                         closeIdle,
+		errFrameTimeout:                        closeFrameTimeout,
+		errFrameTooLarge:                       closeFrameTooLarge,
+		fmt.Errorf("tls: %w", io.EOF):          closeEOF,
+		errors.New("connection reset by peer"): closeReadError,
+	} {
+		if got := closeReason(err); got != want {
+			t.Errorf("closeReason(%v) = %s, want %s", err, got, want)
+		}
+	}
+}
+
+// serveClosed runs serveFrames on one end of a pipe while peer plays the
+// panel on the other, and returns how many connections of the service were
+// closed for reason.
+func serveClosed(t *testing.T, service ServiceConfig, reason string, peer func(client net.Conn)) string {
+	t.Helper()
+	server, client := net.Pipe()
+	defer client.Close()
+	s := &session{conn: server, remote: "pipe", service: service, limiter: accountLimiterFor(service)}
+	done := make(chan struct{})
+	go func() {
+		serveFrames(s, newFrameReader(server, service))
+		server.Close()
+		close(done)
+	}()
+	peer(client)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection kept open")
+	}
+	if got := closedConnections.Get(service.Name + "/" + reason); got != nil {
+		return got.String()
+	}
+	return "0"
+}
+
+func TestServeFramesCloseMetrics(t *testing.T) {
+	base := ServiceConfig{Type: "SURGUARD", EndChar: 0x14}
+	for _, tt := range []struct {
+		name   string
+		config func(*ServiceConfig)
+		reason string
+		peer   func(client net.Conn)
+	}{
+		{"eof", func(*ServiceConfig) {}, closeEOF, func(client net.Conn) { client.Close() }},
+		{"idle", func(s *ServiceConfig) { s.IdleTimeout = 30 * time.Millisecond }, closeIdle, func(net.Conn) {}},
+		{"frame timeout", func(s *ServiceConfig) { s.FrameTimeout = 30 * time.Millisecond }, closeFrameTimeout,
+			func(client net.Conn) { client.Write([]byte("1011")) }},
+		{"too large", func(s *ServiceConfig) { s.MaxFrameSize = 8 }, closeFrameTooLarge,
+			func(client net.Conn) { go client.Write([]byte("501001 181234E13001003\x14")) }},
+		// A heartbeat is ACKed, but the panel never reads the ACK
+		{"write timeout", func(s *ServiceConfig) { s.WriteTimeout = 30 * time.Millisecond }, closeWriteError,
+			func(client net.Conn) { client.Write([]byte("1011           @    \x14")) }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			service := base
+			service.Name = "Close " + tt.name
+			tt.config(&service)
+			if got := serveClosed(t, service, tt.reason, tt.peer); got != "1" {
+				t.Errorf("closed for %s %s times, want 1", tt.reason, got)
+			}
+		})
+	}
+}
+
+func TestServeFramesArchivesDropped(t *testing.T) {
+	dir := t.TempDir()
+	w, err := archive.NewWriter(archive.Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frameArchive = w
+	defer func() { frameArchive = nil }()
+
+	base := ServiceConfig{Type: "SURGUARD", EndChar: 0x14}
+	timeout, tooLarge := base, base
+	timeout.Name, timeout.FrameTimeout = "Dropped timeout", 30*time.Millisecond
+	tooLarge.Name, tooLarge.MaxFrameSize = "Dropped too large", 8
+	serveClosed(t, timeout, closeFrameTimeout, func(client net.Conn) { client.Write([]byte("1011")) })
+	serveClosed(t, tooLarge, closeFrameTooLarge, func(client net.Conn) { go client.Write([]byte("501001 181234E13001003\x14")) })
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := archive.Files(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, file := range files {
+		err := archive.ReadFile(file, func(r archive.Record) error {
+			if r.Direction != archive.Received {
+				t.Errorf("%s: %s record %q", r.Service, r.Direction, r.Frame)
+			}
+			got[r.Service] = r.Outcome + " " + string(r.Frame)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{"Dropped timeout": "timeout 1011", "Dropped too large": "too_large 501001 1"}
+	if !maps.Equal(got, want) {
+		t.Errorf("archived %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"agent/archive"
+	"agent/model"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+ISAPI services take the event notifications Hikvision cameras and AX-series
+hubs POST to an alarm host, see protocol/isapi.go for the XML. Devices with
+a picture send multipart/form-data: the XML part and one or more JPEG
+snapshots. Snapshots are saved under snapshotDir and their paths put in the
+signal; without snapshotDir they are dropped.
+
+	POST /isapi/1234
+	Content-Type: multipart/form-data; boundary=...
+
+	--...  Content-Type: application/xml      <EventNotificationAlert>...
+	--...  Content-Type: image/jpeg           snapshot
+
+A path segment after path is the account, otherwise the device MAC is.
+Devices authenticate with Basic auth, or with a client certificate when
+TLS requires one. They are answered 200 whatever became of the
+notification, except 403 for an account their certificate may not send for
+and 503 when publishing failed, so that they retry. A retry saves its
+snapshots under the same names as the first attempt.
+*/
+
+const (
+	isapiType         = "ISAPI"
+	defaultIsapiPath  = "/"
+	defaultIsapiBody  = 8 << 20
+	maxIsapiSnapshots = 8
+)
+
+// isapiImage is a snapshot part of a notification.
+type isapiImage struct {
+	contentType string
+	data        []byte
+}
+
+// checkIsapi validates the settings of an ISAPI service.
+func checkIsapi(service ServiceConfig) error {
+	if service.Path != "" && !strings.HasPrefix(service.Path, "/") {
+		return fmt.Errorf("path %q must start with /", service.Path)
+	}
+	mtls := service.TLS.Enabled && service.TLS.ClientCAFile != "" && service.TLS.RequireClientCert
+	if (service.Username == "" || service.Password == "") && !mtls {
+		return errors.New("username and password, or TLS with a required client certificate, are needed for ISAPI services")
+	}
+	_, err := parserFor(service)
+	return err
+}
+
+// isapiParts splits a request body into the notification XML and its
+// snapshots. Bodies that are not multipart are the XML itself.
+func isapiParts(contentType string, body []byte) ([]byte, []isapiImage, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return body, nil, nil
+	}
+
+	var alert []byte
+	var images []isapiImage
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return nil, nil, err
+		}
+		partType := part.Header.Get("Content-Type")
+		switch {
+		case strings.HasPrefix(partType, "image/"):
+			if len(images) < maxIsapiSnapshots {
+				images = append(images, isapiImage{contentType: partType, data: data})
+			}
+		case len(alert) == 0 && (strings.Contains(partType, "xml") || bytes.HasPrefix(bytes.TrimSpace(data), []byte("<"))):
+			alert = data
+		}
+	}
+	if len(alert) == 0 {
+		return nil, nil, errors.New("no event notification in multipart body")
+	}
+	return alert, images, nil
+}
+
+var unsafePathChars = regexp.MustCompile(`[^0-9A-Za-z_-]+`)
+
+// pathComponent makes text safe as one file name component.
+func pathComponent(text string) string {
+	if text = unsafePathChars.ReplaceAllString(text, "_"); text == "" || text == "_" {
+		return "unknown"
+	}
+	return text
+}
+
+func snapshotExtension(contentType string) string {
+	switch mediaType, _, _ := mime.ParseMediaType(contentType); mediaType {
+	case "image/jpeg", "image/jpg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	}
+	return ".bin"
+}
+
+// snapshotDigest identifies a notification by its content, so that a retry
+// of it is told apart from a new event.
+func snapshotDigest(alert []byte, images []isapiImage) string {
+	hash := sha256.New()
+	hash.Write(alert)
+	for _, image := range images {
+		hash.Write(image.data)
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:4])
+}
+
+// saveSnapshots stores the snapshots of an alarm as
+// <dir>/<account>/<time>-<event>-<zone>-<digest>-<n>.jpg and returns their
+// paths. The time is the event time the device reports, or at when it has none,
+// so a retried notification overwrites its own files. Snapshots that could
+// not be written are left out.
+func saveSnapshots(dir string, alarm model.AlarmSignal, digest string, images []isapiImage, at time.Time) []string {
+	accountDir := filepath.Join(dir, pathComponent(alarm.SideNo))
+	if err := os.MkdirAll(accountDir, 0o755); err != nil {
+		fmt.Printf("Error creating snapshot directory %s: %v\n", accountDir, err)
+		return nil
+	}
+	if alarm.EventTime != nil {
+		at = *alarm.EventTime
+	}
+	prefix := fmt.Sprintf("%s-%s-%s-%s", at.UTC().Format("20060102-150405.000"), pathComponent(alarm.EventCode), pathComponent(alarm.Zone), digest)
+	var paths []string
+	for i, image := range images {
+		path := filepath.Join(accountDir, fmt.Sprintf("%s-%d%s", prefix, i+1, snapshotExtension(image.contentType)))
+		if err := os.WriteFile(path, image.data, 0o644); err != nil {
+			fmt.Printf("Error saving snapshot %s: %v\n", path, err)
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+type isapiHandler struct {
+	service ServiceConfig
+	path    string
+	deliver func(s *session, signals []interface{}, rawSignal string) error
+}
+
+func newIsapiHandler(service ServiceConfig) *isapiHandler {
+	h := &isapiHandler{service: service, path: service.Path, deliver: deliverSignals}
+	if h.path == "" {
+		h.path = defaultIsapiPath
+	}
+	return h
+}
+
+// account returns the path segment after the handler path, ok is false for
+// paths outside it.
+func (h *isapiHandler) account(path string) (account string, ok bool) {
+	rest, ok := strings.CutPrefix(path, h.path)
+	if !ok || (rest != "" && !strings.HasSuffix(h.path, "/") && !strings.HasPrefix(rest, "/")) {
+		return "", false
+	}
+	rest = strings.Trim(rest, "/")
+	if strings.Contains(rest, "/") {
+		return "", false
+	}
+	return rest, true
+}
+
+func (h *isapiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	service := h.service
+	account, ok := h.account(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if service.Username != "" {
+		username, password, hasAuth := r.BasicAuth()
+		if !hasAuth || subtle.ConstantTimeCompare([]byte(username), []byte(service.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(service.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="alarm"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	maxSize := service.MaxFrameSize
+	if maxSize <= 0 {
+		maxSize = defaultIsapiBody
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxSize)))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s := &session{
+		id:      lastConnId.Add(1),
+		remote:  r.RemoteAddr,
+		service: service,
+		limiter: accountLimiterFor(service),
+	}
+	if r.TLS != nil {
+		if s.accounts, err = certAccounts(r.TLS.PeerCertificates, service); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	code, message := h.handle(s, r.Header.Get("Content-Type"), body, account)
+	http.Error(w, message, code)
+}
+
+// handle parses, stores the snapshots of, publishes and archives one
+// notification, and returns the answer to the device.
+func (h *isapiHandler) handle(s *session, contentType string, body []byte, account string) (int, string) {
+	alert, images, err := isapiParts(contentType, body)
+	if err != nil {
+		fmt.Printf("Invalid ISAPI request from %s: %v\n", s.remote, err)
+		s.archive(archive.Received, body, "unparsed")
+		return http.StatusBadRequest, err.Error()
+	}
+	fmt.Printf("Processing %s data from %s with %d snapshots: %s\n", s.service.Type, s.remote, len(images), alert)
+
+	signals, _, err := parseFrame(alert, s.service)
+	if err != nil || len(signals) == 0 {
+		s.archive(archive.Received, alert, "unparsed")
+		return http.StatusOK, "OK"
+	}
+	if account != "" {
+		for i, signal := range signals {
+			signals[i] = withAccount(signal, account)
+		}
+	}
+	// A device refused for its account would leave snapshots nobody gets
+	if err := checkAccounts(s, signals); err != nil {
+		fmt.Printf("Error delivering ISAPI event from %s: %v\n", s.remote, err)
+		s.archive(archive.Received, alert, rxOutcome("", signals, err))
+		return http.StatusForbidden, err.Error()
+	}
+	now, digest := time.Now(), snapshotDigest(alert, images)
+	for i, signal := range signals {
+		if alarm, isAlarm := signal.(model.AlarmSignal); isAlarm && h.service.SnapshotDir != "" && len(images) > 0 {
+			alarm.Snapshots = saveSnapshots(h.service.SnapshotDir, alarm, digest, images, now)
+			signals[i] = alarm
+		}
+	}
+
+	if err := h.deliver(s, signals, string(alert)); err != nil {
+		fmt.Printf("Error delivering ISAPI event from %s: %v\n", s.remote, err)
+		s.archive(archive.Received, alert, rxOutcome("", signals, err))
+		if errors.Is(err, errAccountNotAllowed) {
+			return http.StatusForbidden, err.Error()
+		}
+		return http.StatusServiceUnavailable, err.Error()
+	}
+	s.archive(archive.Received, alert, "parsed")
+	return http.StatusOK, "OK"
+}
+
+func startIsapi(service ServiceConfig) {
+	handler := newIsapiHandler(service)
+	serveHTTP(service, handler, handler.path)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"agent/model"
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const isapiAlert = `<EventNotificationAlert version="2.0" xmlns="http://www.hikvision.com/ver20/XMLSchema">
+<macAddress>44:19:b6:0a:12:34</macAddress>
+<channelID>1</channelID>
+<dateTime>2024-02-21T01:07:45+03:00</dateTime>
+<eventType>fielddetection</eventType>
+<eventState>active</eventState>
+<channelName>Garden</channelName>
+</EventNotificationAlert>`
+
+// isapiRequest builds a multipart notification with the alert and snapshots.
+func isapiRequest(t *testing.T, path, alert string, snapshots ...string) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="fielddetection"`},
+		"Content-Type":        {"application/xml; charset=UTF-8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(alert))
+	for _, snapshot := range snapshots {
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Disposition": {`form-data; name="fielddetectionImage"; filename="fielddetection.jpg"`},
+			"Content-Type":        {"image/jpeg"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(snapshot))
+	}
+	writer.Close()
+
+	r := httptest.NewRequest(http.MethodPost, path, &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	return r
+}
+
+func TestIsapiHandler(t *testing.T) {
+	service := ServiceConfig{Name: "Cameras", Id: 8, Type: isapiType, Path: "/isapi", SnapshotDir: t.TempDir()}
+	handler := newIsapiHandler(service)
+	var delivered []interface{}
+	handler.deliver = func(s *session, signals []interface{}, rawSignal string) error {
+		delivered = append(delivered, signals...)
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, isapiRequest(t, "/isapi/1234", isapiAlert, "jpeg one", "jpeg two"))
+	if w.Code != http.StatusOK || len(delivered) != 1 {
+		t.Fatalf("code %d, delivered %+v: %s", w.Code, delivered, w.Body)
+	}
+	alarm := delivered[0].(model.AlarmSignal)
+	if alarm.SideNo != "1234" || alarm.EventCode != "BA" || alarm.Zone != "1" || alarm.ZoneName != "Garden" {
+		t.Errorf("alarm %+v", alarm)
+	}
+	if len(alarm.Snapshots) != 2 {
+		t.Fatalf("snapshots %v", alarm.Snapshots)
+	}
+	for i, want := range []string{"jpeg one", "jpeg two"} {
+		path := alarm.Snapshots[i]
+		name := filepath.Base(path)
+		if filepath.Dir(path) != filepath.Join(service.SnapshotDir, "1234") || !strings.HasPrefix(name, "20240220-220745.000-BA-1-") ||
+			!strings.HasSuffix(name, "-"+string(rune('1'+i))+".jpg") {
+			t.Errorf("snapshot path %s", path)
+		}
+		if data, err := os.ReadFile(path); err != nil || string(data) != want {
+			t.Errorf("snapshot %s: %q, %v", path, data, err)
+		}
+	}
+
+	// A bare XML body, the MAC as the account
+	delivered = nil
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/isapi", strings.NewReader(isapiAlert))
+	r.Header.Set("Content-Type", "application/xml")
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || len(delivered) != 1 {
+		t.Fatalf("code %d, delivered %+v: %s", w.Code, delivered, w.Body)
+	}
+	if alarm := delivered[0].(model.AlarmSignal); alarm.SideNo != "4419B60A1234" || alarm.Snapshots != nil {
+		t.Errorf("alarm %+v", alarm)
+	}
+}
+
+func TestIsapiHandlerRejected(t *testing.T) {
+	service := ServiceConfig{Name: "Cameras", Id: 8, Type: isapiType, Path: "/isapi", Username: "admin", Password: "s3cret"}
+	handler := newIsapiHandler(service)
+	handler.deliver = func(s *session, signals []interface{}, rawSignal string) error {
+		t.Errorf("delivered %+v", signals)
+		return nil
+	}
+
+	for _, tt := range []struct {
+		name     string
+		request  *http.Request
+		password string
+		code     int
+	}{
+		{"wrong path", isapiRequest(t, "/isapix", isapiAlert), "s3cret", http.StatusNotFound},
+		{"nested path", isapiRequest(t, "/isapi/1234/5678", isapiAlert), "s3cret", http.StatusNotFound},
+		{"get", httptest.NewRequest(http.MethodGet, "/isapi", nil), "s3cret", http.StatusMethodNotAllowed},
+		{"wrong password", isapiRequest(t, "/isapi", isapiAlert), "guess", http.StatusUnauthorized},
+		{"no notification", isapiRequest(t, "/isapi", ""), "s3cret", http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.request.SetBasicAuth("admin", tt.password)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, tt.request)
+			if w.Code != tt.code {
+				t.Errorf("code %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+		})
+	}
+}
+
+func TestIsapiRetrySnapshots(t *testing.T) {
+	service := ServiceConfig{Name: "Cameras", Id: 8, Type: isapiType, Path: "/isapi", SnapshotDir: t.TempDir()}
+	handler := newIsapiHandler(service)
+	var delivered [][]string
+	handler.deliver = func(s *session, signals []interface{}, rawSignal string) error {
+		delivered = append(delivered, signals[0].(model.AlarmSignal).Snapshots)
+		if len(delivered) == 1 {
+			return errors.New("pubsub down")
+		}
+		return nil
+	}
+
+	for _, want := range []int{http.StatusServiceUnavailable, http.StatusOK} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, isapiRequest(t, "/isapi/1234", isapiAlert, "jpeg one"))
+		if w.Code != want {
+			t.Fatalf("code %d, want %d: %s", w.Code, want, w.Body)
+		}
+	}
+	if len(delivered) != 2 || !slices.Equal(delivered[0], delivered[1]) {
+		t.Errorf("retry saved %v, first attempt %v", delivered[1], delivered[0])
+	}
+	if files, _ := os.ReadDir(filepath.Join(service.SnapshotDir, "1234")); len(files) != 1 {
+		t.Errorf("%d snapshot files, want 1", len(files))
+	}
+
+	// Another event of the same camera gets files of its own
+	handler.ServeHTTP(httptest.NewRecorder(), isapiRequest(t, "/isapi/1234", isapiAlert, "jpeg two"))
+	if files, _ := os.ReadDir(filepath.Join(service.SnapshotDir, "1234")); len(files) != 2 {
+		t.Errorf("%d snapshot files, want 2", len(files))
+	}
+}
+
+func TestIsapiRefusedAccountSavesNothing(t *testing.T) {
+	service := ServiceConfig{Name: "Cameras", Id: 8, Type: isapiType, SnapshotDir: t.TempDir()}
+	handler := newIsapiHandler(service)
+	handler.deliver = func(s *session, signals []interface{}, rawSignal string) error {
+		t.Errorf("delivered %+v", signals)
+		return nil
+	}
+
+	// The client certificate only covers another account
+	s := &session{remote: "pipe", service: service, accounts: map[string]bool{"9999": true}, limiter: accountLimiterFor(service)}
+	r := isapiRequest(t, "/1234", isapiAlert, "jpeg one")
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, message := handler.handle(s, r.Header.Get("Content-Type"), body, "1234"); code != http.StatusForbidden {
+		t.Errorf("code %d, want %d: %s", code, http.StatusForbidden, message)
+	}
+	if files, err := os.ReadDir(service.SnapshotDir); err != nil || len(files) != 0 {
+		t.Errorf("snapshot directory has %d entries, %v; want none", len(files), err)
+	}
+}
+
+func TestCheckIsapi(t *testing.T) {
+	mtls := TLSConfig{Enabled: true, ClientCAFile: "ca.pem", RequireClientCert: true}
+	for _, tt := range []struct {
+		name    string
+		service ServiceConfig
+		ok      bool
+	}{
+		{"basic auth", ServiceConfig{Type: isapiType, Username: "admin", Password: "s3cret"}, true},
+		{"client certificate", ServiceConfig{Type: isapiType, TLS: mtls}, true},
+		{"no authentication", ServiceConfig{Type: isapiType}, false},
+		{"username only", ServiceConfig{Type: isapiType, Username: "admin"}, false},
+		{"password only", ServiceConfig{Type: isapiType, Password: "s3cret"}, false},
+		{"client certificate optional", ServiceConfig{Type: isapiType, TLS: TLSConfig{Enabled: true, ClientCAFile: "ca.pem"}}, false},
+		{"bad path", ServiceConfig{Type: isapiType, Username: "admin", Password: "s3cret", Path: "isapi"}, false},
+	} {
+		if err := checkIsapi(tt.service); (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
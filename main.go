@@ -1,18 +1,24 @@
 package main
 
 import (
+	"agent/archive"
+	"agent/model"
+	"agent/output"
 	"agent/protocol"
-	"bufio"
 	"cloud.google.com/go/pubsub"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"gopkg.in/yaml.v3"
-	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -20,8 +26,51 @@ type ServiceConfig struct {
 	Name    string `yaml:"name"`
 	Id      int    `yaml:"id"`
 	Port    int    `yaml:"port"`
-	Type    string `yaml:"type"`    // SURGUARD or ADM-CID or DC09
+	Type    string `yaml:"type"`    // SURGUARD, ADEMCO, RADIONICS, OH, DC07, DC09, TEKNIM, FONRI, HTTP, ISAPI or MQTT
 	EndChar byte   `yaml:"endChar"` // Delimiter byte
+
+	// Connect services only
+	Hosts       []string      `yaml:"hosts"`       // host or host:port, primary first; defaults to localhost
+	DialTimeout time.Duration `yaml:"dialTimeout"` // Per attempt, e.g. 10s
+	KeepAlive   time.Duration `yaml:"keepAlive"`   // TCP keepalive period, 0 uses the Go default of 15s, negative disables
+	Backoff     BackoffConfig `yaml:"backoff"`     // Delay between reconnect rounds
+	TLS         TLSConfig     `yaml:"tls"`
+	Login       string        `yaml:"login"` // Handshake string sent right after connecting
+
+	Key     string `yaml:"key"`     // DC-09 family: hex AES key for encrypted messages
+	Profile string `yaml:"profile"` // DC-09 family: vendor dialect, e.g. prosec; the type's own when empty
+
+	CidChecksum string `yaml:"cidChecksum"` // Raw Contact ID checksum errors: off, flag (default) or nak
+
+	RegexFile string           `yaml:"regexFile"` // JSON or YAML regex overrides, see protocol.RegexSet
+	Regexes   []model.SubRegex `yaml:"regexes"`   // Inline overrides, applied after regexFile
+
+	IdleTimeout  time.Duration `yaml:"idleTimeout"`  // Drop the connection when nothing arrives for this long (half-open detection)
+	FrameTimeout time.Duration `yaml:"frameTimeout"` // First byte to EndChar, default 30s, negative disables
+	MaxFrameSize int           `yaml:"maxFrameSize"` // Bytes before EndChar, default 4096
+	WriteTimeout time.Duration `yaml:"writeTimeout"` // Sending an ACK, default 10s
+
+	RateLimit RateLimitConfig `yaml:"rateLimit"` // Flood protection for alarm signals
+
+	// Listen services only
+	Allow          []string `yaml:"allow"`          // CIDRs or addresses allowed to connect, empty allows all
+	Deny           []string `yaml:"deny"`           // CIDRs or addresses always refused, checked before allow
+	MaxConnsPerIP  int      `yaml:"maxConnsPerIP"`  // Concurrent connections per source IP, 0 is unlimited
+	MaxConnections int      `yaml:"maxConnections"` // Concurrent connections for the whole service, 0 is unlimited
+
+	// HTTP services only, see webhook.go
+	Path   string            `yaml:"path"`   // Endpoint, default /signals
+	Token  string            `yaml:"token"`  // Required bearer token
+	Fields map[string]string `yaml:"fields"` // Signal field to JSON path, e.g. sideNo: panel.account
+
+	// MQTT services only, connect services with the broker in hosts; see mqtt.go
+	ClientId string      `yaml:"clientId"` // Default agent-<name>, the broker keeps our session under it
+	Username string      `yaml:"username"` // Also the Basic auth ISAPI devices must send, none when empty
+	Password string      `yaml:"password"`
+	Topics   []TopicRule `yaml:"topics"`
+
+	// ISAPI services only, see isapi.go; path is the prefix of /<account>, default /
+	SnapshotDir string `yaml:"snapshotDir"` // Where alarm snapshots are saved, dropped when empty
 }
 
 type MonitoringCenter struct {
@@ -33,11 +82,17 @@ type Config struct {
 	Center          MonitoringCenter `yaml:"monitoringCenter"`
 	ListenServices  []ServiceConfig  `yaml:"listenServices"`
 	ConnectServices []ServiceConfig  `yaml:"connectServices"`
+	MetricsAddr     string           `yaml:"metricsAddr"` // e.g. 127.0.0.1:9100, counters on /debug/vars
+	Archive         archive.Config   `yaml:"archive"`     // Raw frame archive
+	Outputs         []output.Config  `yaml:"outputs"`     // Automation software fed with every published signal
 }
 
 var (
 	pubsubClient *pubsub.Client
 	conf         Config
+	frameArchive *archive.Writer   // nil when archiving is off
+	outputs      []*output.Channel // Fed after every successful publish
+	lastConnId   atomic.Uint64
 )
 
 func initPubSubClient(projectID string) (*pubsub.Client, error) {
@@ -49,18 +104,60 @@ func initPubSubClient(projectID string) (*pubsub.Client, error) {
 	return client, nil
 }
 
+// loadConfig reads and parses the YAML configuration file into conf.
+func loadConfig(path string) error {
+	configFile, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(configFile, &conf)
+}
+
+// findService returns the listen or connect service with the given name.
+func findService(name string) (ServiceConfig, bool) {
+	for _, service := range append(conf.ListenServices, conf.ConnectServices...) {
+		if service.Name == name {
+			return service, true
+		}
+	}
+	return ServiceConfig{}, false
+}
+
 func main() {
+	// Subcommands, the receiver itself runs without arguments
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "replay":
+			err = runReplay(os.Args[2:])
+		case "simulate":
+			err = runSimulate(os.Args[2:])
+		case "parse":
+			err = runParse(os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %q, expected replay, simulate or parse", os.Args[1])
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Load and parse the YAML configuration file
-	configFile, err := os.ReadFile("conf.yaml")
-	if err != nil {
+	if err := loadConfig("conf.yaml"); err != nil {
 		panic(err)
 	}
-	if err := yaml.Unmarshal(configFile, &conf); err != nil {
-		panic(err)
+
+	// Fail early on bad regex overrides, HTTP and MQTT settings
+	for _, service := range append(conf.ListenServices, conf.ConnectServices...) {
+		if err := checkService(service); err != nil {
+			panic(fmt.Errorf("service %s: %w", service.Name, err))
+		}
 	}
 
 	// Initialize the Pub/Sub client
-
+	var err error
 	pubsubClient, err = initPubSubClient("bulutalarm") // Replace with your actual project ID
 	if err != nil {
 		fmt.Println("Failed to create Pub/Sub client:", err)
@@ -68,28 +165,83 @@ func main() {
 	}
 	defer pubsubClient.Close()
 
+	if conf.MetricsAddr != "" {
+		go startMetrics(conf.MetricsAddr)
+	}
+	go endQuietFloods()
+
+	if conf.Archive.Dir != "" {
+		frameArchive, err = archive.NewWriter(conf.Archive)
+		if err != nil {
+			fmt.Println("Failed to open frame archive:", err)
+			return
+		}
+		defer frameArchive.Close()
+	}
+
+	for _, config := range conf.Outputs {
+		channel, err := output.New(config)
+		if err != nil {
+			fmt.Println("Failed to start output:", err)
+			return
+		}
+		outputs = append(outputs, channel)
+		go func() {
+			if err := channel.Run(); err != nil {
+				fmt.Printf("Output %s stopped: %v\n", config.Name, err)
+			}
+		}()
+	}
+
 	// Start listeners for services that this app listens to
 	for _, service := range conf.ListenServices {
+		if service.Type == httpType {
+			go startWebhook(service)
+			continue
+		}
+		if service.Type == isapiType {
+			go startIsapi(service)
+			continue
+		}
 		go startListener(service)
 	}
 
 	// Start connecting to services that this app needs to connect to
 	for _, service := range conf.ConnectServices {
+		if service.Type == mqttType {
+			go startMqtt(service)
+			continue
+		}
 		go startConnector(service)
 	}
 
-	// Block forever (or until the program is manually stopped)
-	select {}
+	// Block until the program is stopped, then let the deferred closes flush
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	fmt.Println("Shutting down")
 }
 
 func startListener(service ServiceConfig) {
+	adm, err := newAdmission(service)
+	if err != nil {
+		fmt.Printf("Invalid access list for service %s: %v\n", service.Name, err)
+		return
+	}
+
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", service.Port))
 	if err != nil {
 		fmt.Printf("Error starting listener on port %d for service %s: %v\n", service.Port, service.Name, err)
 		return
 	}
+	if service.TLS.Enabled {
+		if ln, err = newTLSListener(ln, service); err != nil {
+			fmt.Printf("Error setting up TLS on port %d for service %s: %v\n", service.Port, service.Name, err)
+			return
+		}
+	}
 	defer ln.Close()
-	fmt.Printf("Listening on port %d for service %s with type %s\n", service.Port, service.Name, service.Type)
+	fmt.Printf("Listening on port %d for service %s with type %s (TLS: %t)\n", service.Port, service.Name, service.Type, service.TLS.Enabled)
 
 	for {
 		conn, err := ln.Accept()
@@ -97,57 +249,105 @@ func startListener(service ServiceConfig) {
 			fmt.Printf("Error accepting connection for service %s: %v\n", service.Name, err)
 			continue
 		}
-		go handleConnection(conn, service)
-	}
-}
 
-func startConnector(service ServiceConfig) {
-	for {
-		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", service.Port))
-		if err != nil {
-			fmt.Printf("Error connecting to service %s on port %d: %v\n", service.Name, service.Port, err)
-			time.Sleep(time.Second * 5) // Wait before retrying
+		release, reason := adm.admit(conn.RemoteAddr())
+		if reason != "" {
+			fmt.Printf("Rejected connection from %s for service %s: %s\n", conn.RemoteAddr(), service.Name, reason)
+			countRejected(service, reason)
+			conn.Close()
 			continue
 		}
-		fmt.Printf("Connected to service %s on port %d\n", service.Name, service.Port)
+		countAccepted(service)
 
-		handleConnection(conn, service)
-
-		fmt.Printf("Disconnected from service %s on port %d, attempting to reconnect...\n", service.Name, service.Port)
-		// The connection will attempt to reconnect after handling in handleConnection completes
+		go func() {
+			defer release()
+			handleConnection(conn, service)
+		}()
 	}
 }
 
+// session carries per-connection state through the read/ack loop.
+type session struct {
+	id           uint64
+	conn         net.Conn // nil for HTTP requests
+	remote       string
+	service      ServiceConfig
+	accounts     map[string]bool   // Accounts the TLS client certificate may report, nil allows any
+	limiter      *accountLimiter   // Shared by all connections of the service
+	flood        floodWindow       // Per-connection rate limit, guarded by limiter.mu
+	floodAccount string            // Account whose signal started the connection flood
+	dc07Last     map[string]string // Last DC-07 sequence number delivered by receiver/line
+}
+
+// maxDc07Lines bounds session.dc07Last against senders making up receivers
+// and lines.
+const maxDc07Lines = 10000
+
 func handleConnection(conn net.Conn, service ServiceConfig) {
 	defer conn.Close()
-	r := bufio.NewReader(conn)
-
-	for {
-		var data []byte
-		var err error
 
-		data, err = r.ReadBytes(service.EndChar)
-		//fmt.Println("ReadLine", data)
+	// Bound the TLS handshake like any other frame
+	frames := newFrameReader(conn, service)
+	if frames.frameTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(frames.frameTimeout))
+	}
+	accounts, err := clientAccounts(conn, service)
+	if err != nil {
+		fmt.Printf("Rejected client %s for service %s: %v\n", conn.RemoteAddr(), service.Name, err)
+		countClosed(service, closeClientRefused)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s := &session{
+		id:       lastConnId.Add(1),
+		conn:     conn,
+		remote:   conn.RemoteAddr().String(),
+		service:  service,
+		accounts: accounts,
+		limiter:  accountLimiterFor(service),
+	}
+	serveFrames(s, frames)
+}
 
+// serveFrames runs the read/ack loop of a connection until it fails or a
+// frame reports an account the client certificate may not report.
+func serveFrames(s *session, frames *frameReader) {
+	conn, service := s.conn, s.service
+	for {
+		data, err := frames.next()
 		if err != nil {
-			if err != io.EOF {
-				fmt.Printf("Error reading for type %s: %v\n", service.Type, err)
+			reason := closeReason(err)
+			if reason != closeEOF {
+				fmt.Printf("Closing connection from %s for type %s: %v\n", conn.RemoteAddr(), service.Type, err)
+			}
+			if len(data) > 0 {
+				s.archive(archive.Received, data, droppedOutcome(reason))
 			}
-			break
+			countClosed(service, reason)
+			return
 		}
-		if len(data) > 1 {
-			data = data[:len(data)-1] // Remove the delimiter
-		} else {
+		if len(data) == 0 {
 			continue // No actual data to process
 		}
 
-		ack, handleDataErr := handleData(data, service)
+		ack, event, handleDataErr := handleData(data, s)
+		s.archive(archive.Received, data, rxOutcome(ack, event, handleDataErr))
 		fmt.Println("ACK:", ack)
 		if handleDataErr == nil {
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout(service)))
 			if _, err := conn.Write([]byte(ack)); err != nil {
 				fmt.Printf("Error sending ack for type %s: %v\n", service.Type, err)
-				break
+				countClosed(service, closeWriteError)
+				return
+			}
+			if ack != "" {
+				s.archive(archive.Sent, []byte(ack), txOutcome(ack))
 			}
+		} else if errors.Is(handleDataErr, errAccountNotAllowed) {
+			// No ACK would ever come, the panel would send the frame forever
+			fmt.Printf("Closing connection from %s for type %s: %v\n", conn.RemoteAddr(), service.Type, handleDataErr)
+			countClosed(service, closeAccountRefused)
+			return
 		} else {
 			fmt.Printf("Error handling data for type %s: %v. Retrying...\n", service.Type, handleDataErr)
 			time.Sleep(1 * time.Second) // Retry logic can be more sophisticated
@@ -155,49 +355,228 @@ func handleConnection(conn net.Conn, service ServiceConfig) {
 	}
 }
 
-func handleData(data []byte, service ServiceConfig) (ack string, err error) {
-	dataType := service.Type
-	receiverId := strconv.Itoa(service.Id)
-	event := []interface{}(nil)
-	// Simulate processing data differently based on the type
-	fmt.Printf("Processing %s data: %s", dataType, string(data))
+// archive records a frame exchanged on this connection when archiving is on.
+func (s *session) archive(direction string, frame []byte, outcome string) {
+	if frameArchive == nil {
+		return
+	}
+	frameArchive.Write(archive.Record{
+		Time:      time.Now(),
+		Service:   s.service.Name,
+		Type:      s.service.Type,
+		ConnId:    s.id,
+		Remote:    s.remote,
+		Direction: direction,
+		Frame:     append([]byte(nil), frame...),
+		Outcome:   outcome,
+	})
+}
 
-	switch dataType {
-	case "SURGUARD":
-		event, ack, err = protocol.ParseSurguard(string(data), receiverId)
-		if err != nil {
-			return "", err
-		}
-	case "ADEMCO":
-		event, ack, err = protocol.ParseAdemco(string(data), receiverId)
-		if err != nil {
-			return "", err
+// txOutcome tells the ACKs and NAKs sent apart in the archive.
+func txOutcome(ack string) string {
+	if protocol.IsNak(ack) {
+		return "nak"
+	}
+	return "ack"
+}
+
+// droppedOutcome is the archive outcome of a partial frame the connection was
+// closed on.
+func droppedOutcome(reason string) string {
+	if reason == closeFrameTooLarge {
+		return "too_large"
+	}
+	return "timeout"
+}
+
+// rxOutcome tells how a received frame was handled, for the archive. Frames
+// that only gave unparsed signals are unparsed, to be found for replay.
+func rxOutcome(ack string, event []interface{}, err error) string {
+	decoded := 0
+	for _, e := range event {
+		if !model.IsUnparsed(e) {
+			decoded++
 		}
-	case "DC09":
-		event, ack, err = protocol.ParseDc09(string(data), receiverId)
+	}
+	switch {
+	case errors.Is(err, errAccountNotAllowed):
+		return "refused"
+	case err != nil:
+		return "error"
+	case protocol.IsNak(ack):
+		return "rejected" // Answered with a NAK, e.g. a bad checksum
+	case decoded > 0:
+		return "parsed"
+	case len(event) == 0 && ack != "":
+		return "no_signal" // ACKed without signals, e.g. a heartbeat
+	}
+	return "unparsed"
+}
+
+// checkService validates the parser, HTTP, ISAPI or MQTT settings of a service.
+func checkService(service ServiceConfig) error {
+	switch service.Type {
+	case httpType:
+		return checkWebhook(service)
+	case isapiType:
+		return checkIsapi(service)
+	case mqttType:
+		_, err := newMqttInput(service)
+		return err
+	}
+	_, err := parserFor(service)
+	return err
+}
+
+var (
+	parsersMu sync.Mutex
+	parsers   = map[string]*protocol.Parser{}
+)
+
+// parserFor returns the parser of a service, built once with the service's
+// regex overrides.
+func parserFor(service ServiceConfig) (*protocol.Parser, error) {
+	parsersMu.Lock()
+	defer parsersMu.Unlock()
+
+	key := service.Name + "/" + service.Type + "/" + service.Profile
+	if parser, exists := parsers[key]; exists {
+		return parser, nil
+	}
+
+	overrides := service.Regexes
+	if service.RegexFile != "" {
+		defs, err := protocol.LoadRegexFile(service.RegexFile)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-	case "TEKNIM":
-		event, ack, err = protocol.ParseTeknim(string(data), receiverId)
-		if err != nil {
-			return "", err
+		overrides = append(defs, service.Regexes...)
+	}
+	parser, err := protocol.NewParser(service.Type, protocol.Options{
+		Profile:     service.Profile,
+		Regexes:     overrides,
+		CidChecksum: service.CidChecksum,
+	})
+	if err != nil {
+		return nil, err
+	}
+	parsers[key] = parser
+	return parser, nil
+}
+
+// parseFrame runs one frame through the parser of the service type. It has no
+// side effects, so replay and the offline tools share it with handleData.
+func parseFrame(data []byte, service ServiceConfig) (event []interface{}, ack string, err error) {
+	if service.Type == httpType || service.Type == jsonType {
+		event, err = webhookSignals(data, service, "")
+		return event, "", err
+	}
+	frame := string(data)
+	receiverId := strconv.Itoa(service.Id)
+
+	encrypted := service.Key != "" && protocol.IsEncryptedDc09(frame)
+	if encrypted {
+		if frame, err = protocol.DecryptDc09(frame, service.Key); err != nil {
+			return nil, "", err
 		}
-	case "FONRI":
-		event, ack, err = protocol.ParseFonri(string(data), receiverId)
-		if err != nil {
-			return "", err
+	}
+
+	parser, err := parserFor(service)
+	if err != nil {
+		return nil, "", err
+	}
+	event, ack, err = parser.Parse(frame, receiverId)
+
+	if encrypted && err == nil && ack != "" {
+		ack, err = protocol.EncryptDc09Ack(ack, service.Key)
+	}
+	return event, ack, err
+}
+
+// handleData parses and publishes one frame and returns the ACK to send along
+// with the signals the parser found.
+func handleData(data []byte, s *session) (ack string, event []interface{}, err error) {
+	service := s.service
+	dataType := service.Type
+	// Simulate processing data differently based on the type
+	fmt.Printf("Processing %s data: %s", dataType, string(data))
+
+	// A DC-07 message repeating the last sequence delivered from its line is a
+	// retransmission of one we ACKed, the ACK was lost
+	dc07Line, dc07Seq, isDc07 := "", "", false
+	if dataType == "DC07" {
+		if dc07Line, dc07Seq, isDc07 = protocol.Dc07Sequence(string(data)); isDc07 && s.dc07Last[dc07Line] == dc07Seq {
+			fmt.Println("Repeated DC-07 sequence", dc07Seq)
+			return protocol.Dc07Ack(dc07Seq), nil, nil
 		}
+	}
 
-	default:
-		fmt.Printf("Unknown service type: %s\n", dataType)
+	event, ack, err = parseFrame(data, service)
+	if err != nil {
+		return "", nil, err
 	}
 
 	if event == nil {
+		// Heartbeats and frames the parser could only ACK
 		fmt.Println("Event is nil")
-		return "", nil
+		return ack, nil, nil
+	}
+
+	if err := deliverSignals(s, event, string(data)); err != nil {
+		return "", event, err
+	}
+	if isDc07 {
+		if s.dc07Last == nil || len(s.dc07Last) >= maxDc07Lines {
+			s.dc07Last = map[string]string{}
+		}
+		s.dc07Last[dc07Line] = dc07Seq
+	}
+
+	//fmt.Println("Published a message to the topic for", dataType, event)
+	return ack, event, nil
+}
+
+var errAccountNotAllowed = errors.New("account is not allowed for this client certificate")
+
+// deliverSignals checks the accounts of parsed signals against the client
+// certificate, applies the rate limits, publishes what is left and feeds it
+// to the outputs.
+func deliverSignals(s *session, event []interface{}, rawSignal string) error {
+	if err := checkAccounts(s, event); err != nil {
+		return err
 	}
 
+	event = limitSignals(s, event, rawSignal)
+
+	if err := publish(event, nil); err != nil {
+		return err
+	}
+	for _, channel := range outputs {
+		channel.Send(event)
+	}
+	return nil
+}
+
+// checkAccounts fails with errAccountNotAllowed when a signal reports an
+// account the client certificate of the session may not report.
+func checkAccounts(s *session, event []interface{}) error {
+	if s.accounts == nil {
+		return nil
+	}
+	for _, e := range event {
+		if account := model.SignalAccount(e); !s.accounts[account] {
+			return fmt.Errorf("%w: %s", errAccountNotAllowed, account)
+		}
+	}
+	return nil
+}
+
+// publishSignals publishes each signal to the event topic and waits for the
+// results. attributes are attached to every message.
+// publish sends signals to Pub/Sub, replaced in tests.
+var publish = publishSignals
+
+func publishSignals(event []interface{}, attributes map[string]string) error {
 	topic := pubsubClient.Topic("event")
 	ctx := context.Background()
 
@@ -209,7 +588,7 @@ func handleData(data []byte, service ServiceConfig) (ack string, err error) {
 
 		if jsonData == nil {
 			fmt.Println("JSON is empty, jsonData: ", string(jsonData))
-			return "", nil
+			return nil
 		}
 		empJSON, err := json.MarshalIndent(string(jsonData), "", " ")
 		if err != nil {
@@ -220,19 +599,18 @@ func handleData(data []byte, service ServiceConfig) (ack string, err error) {
 
 		// Create a message
 		msg := &pubsub.Message{
-			Data: jsonData,
+			Data:       jsonData,
+			Attributes: attributes,
 		}
 
 		result := topic.Publish(ctx, msg)
 
 		_, err = result.Get(ctx)
 		if err != nil {
-			fmt.Println("failed to publish to topic: %v", err)
-			return "", err
+			fmt.Printf("failed to publish to topic: %v\n", err)
+			return err
 		}
 
 	}
-
-	//fmt.Println("Published a message to the topic for", dataType, event)
-	return ack, nil
+	return nil
 }
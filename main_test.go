@@ -0,0 +1,119 @@
+package main
+
+import (
+	"agent/model"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServeFramesAccountRefused(t *testing.T) {
+	service := ServiceConfig{Name: "Refused", Id: 3, Type: "CID", EndChar: '\n'}
+	server, client := net.Pipe()
+	defer client.Close()
+	s := &session{
+		conn:     server,
+		remote:   "pipe",
+		service:  service,
+		accounts: map[string]bool{"9999": true},
+		limiter:  accountLimiterFor(service),
+	}
+	done := make(chan struct{})
+	go func() {
+		serveFrames(s, newFrameReader(server, service))
+		server.Close()
+		close(done)
+	}()
+
+	if _, err := client.Write([]byte("1234 18 1130 01 003\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection kept open")
+	}
+	if n, err := client.Read(make([]byte, 16)); err != io.EOF {
+		t.Errorf("read %d bytes, %v; want EOF without an ACK", n, err)
+	}
+	if got := closedConnections.Get("Refused/" + closeAccountRefused); got == nil || got.String() != "1" {
+		t.Errorf("refused connections counted %v, want 1", got)
+	}
+}
+
+func TestTxOutcome(t *testing.T) {
+	for ack, want := range map[string]string{
+		"\x06":                               "ack",
+		"\x15":                               "nak",
+		"\n\"ACK\"0001\r":                    "ack",
+		"\n\"NAK\"0001\r":                    "nak",
+		"F4C1\"ACK\"0001R0L0#1234[]\r":       "ack",
+		"8A2F\"NAK\"0000R0L0A0[]_20:14:00\r": "nak",
+	} {
+		if got := txOutcome(ack); got != want {
+			t.Errorf("txOutcome(%q) = %s, want %s", ack, got, want)
+		}
+	}
+}
+
+func TestRxOutcome(t *testing.T) {
+	alarm := model.AlarmSignal{Type: "event", SideNo: "1234", EventCode: "E130"}
+	unparsed := model.AlarmSignal{Type: model.UnparsedType, SideNo: "1234"}
+	for _, tt := range []struct {
+		name  string
+		ack   string
+		event []interface{}
+		err   error
+		want  string
+	}{
+		{"parsed", "\x06", []interface{}{alarm}, nil, "parsed"},
+		{"parsed with unparsed", "\x06", []interface{}{unparsed, alarm}, nil, "parsed"},
+		{"only unparsed", "\x06", []interface{}{unparsed}, nil, "unparsed"},
+		{"heartbeat", "\x06", nil, nil, "no_signal"},
+		{"not understood", "", nil, nil, "unparsed"},
+		{"publish failed", "", []interface{}{alarm}, errors.New("pubsub down"), "error"},
+		{"account refused", "", []interface{}{alarm}, errAccountNotAllowed, "refused"},
+		{"bad checksum", "\x15", nil, nil, "rejected"},
+	} {
+		if got := rxOutcome(tt.ack, tt.event, tt.err); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHandleDataDc07Retransmit(t *testing.T) {
+	var published [][]interface{}
+	publishErr := errors.New("pubsub down")
+	publish = func(event []interface{}, attributes map[string]string) error {
+		if publishErr != nil {
+			return publishErr
+		}
+		published = append(published, event)
+		return nil
+	}
+	t.Cleanup(func() { publish = publishSignals })
+
+	service := ServiceConfig{Name: "Chained", Id: 5, Type: "DC07", EndChar: '\r'}
+	s := &session{remote: "pipe", service: service, limiter: accountLimiterFor(service)}
+	frame := []byte("\n\"ADM-CID\"0042R1L2#1234[#1234|1130 01 003]")
+
+	// Publishing fails: no ACK, the receiver sends the same sequence again
+	if ack, _, err := handleData(frame, s); err == nil || ack != "" {
+		t.Fatalf("failed delivery: ack %q, err %v", ack, err)
+	}
+	publishErr = nil
+	if ack, _, err := handleData(frame, s); err != nil || ack != "\n\"ACK\"0042\r" || len(published) != 1 {
+		t.Fatalf("retransmission: ack %q, err %v, published %v", ack, err, published)
+	}
+	// Our ACK got lost and it comes once more: ACKed, not published twice
+	if ack, event, err := handleData(frame, s); err != nil || ack != "\n\"ACK\"0042\r" || event != nil || len(published) != 1 {
+		t.Fatalf("repeat: ack %q, event %v, err %v, published %d", ack, event, err, len(published))
+	}
+	// Another connection has its own sequence state
+	other := &session{remote: "pipe", service: service, limiter: accountLimiterFor(service)}
+	if _, _, err := handleData(frame, other); err != nil || len(published) != 2 {
+		t.Fatalf("other connection: err %v, published %d", err, len(published))
+	}
+}
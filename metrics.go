@@ -0,0 +1,44 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+)
+
+// Counters are keyed by service name, or "<service name>/<reason>", and served as JSON on
+// /debug/vars when metricsAddr is configured.
+var (
+	acceptedConnections = expvar.NewMap("acceptedConnections")
+	rejectedConnections = expvar.NewMap("rejectedConnections")
+	closedConnections   = expvar.NewMap("closedConnections")
+	suppressedSignals   = expvar.NewMap("suppressedSignals")
+	runawayPanels       = expvar.NewMap("runawayPanels")
+)
+
+func countAccepted(service ServiceConfig) {
+	acceptedConnections.Add(service.Name, 1)
+}
+
+func countRejected(service ServiceConfig, reason string) {
+	rejectedConnections.Add(service.Name+"/"+reason, 1)
+}
+
+func startMetrics(addr string) {
+	fmt.Printf("Serving metrics on %s/debug/vars\n", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		fmt.Printf("Error serving metrics on %s: %v\n", addr, err)
+	}
+}
+
+func countClosed(service ServiceConfig, reason string) {
+	closedConnections.Add(service.Name+"/"+reason, 1)
+}
+
+func countSuppressed(service ServiceConfig) {
+	suppressedSignals.Add(service.Name, 1)
+}
+
+func countRunaway(service ServiceConfig) {
+	runawayPanels.Add(service.Name, 1)
+}
@@ -8,24 +8,49 @@ import (
 
 // SubRegex struct, her bir regex ifadesi için metadata ve derlenmiş regex'i tutar
 type SubRegex struct {
-	Name          string
-	RegexText     string
-	IsActive      bool
-	CompiledRegex *regexp.Regexp
+	Name          string         `yaml:"name"`
+	RegexText     string         `yaml:"regexText"`
+	IsActive      *bool          `yaml:"isActive"` // Left out (nil) counts as active
+	CompiledRegex *regexp.Regexp `yaml:"-" json:"-"`
+}
+
+// Active reports whether the regex is used; one without isActive is.
+func (r SubRegex) Active() bool {
+	return r.IsActive == nil || *r.IsActive
 }
 
 type AlarmSignal struct {
-	Type             string    `json:"type"`
-	SideNo           string    `json:"sideNo"`
-	ReceiverId       string    `json:"receiverId"`
-	ReceiverNo       string    `json:"receiverNo"`
-	LineNo           string    `json:"lineNo"`
-	PartNo           string    `json:"partNo"`
-	MonitoringCenter int       `json:"monitoringCenter"`
-	SignalDateTime   time.Time `json:"signalDateTime"`
-	EventCode        string    `json:"eventCode"`
-	Zone             string    `json:"zone"`
-	RawSignal        string    `json:"rawSignal"`
+	Type             string     `json:"type"`
+	SideNo           string     `json:"sideNo"`
+	ReceiverId       string     `json:"receiverId"`
+	ReceiverNo       string     `json:"receiverNo"`
+	LineNo           string     `json:"lineNo"`
+	PartNo           string     `json:"partNo"`
+	MonitoringCenter int        `json:"monitoringCenter"`
+	SignalDateTime   time.Time  `json:"signalDateTime"`
+	EventCode        string     `json:"eventCode"`
+	Zone             string     `json:"zone"`
+	ZoneName         string     `json:"zoneName,omitempty"`
+	UserNo           string     `json:"userNo,omitempty"`
+	UserName         string     `json:"userName,omitempty"`
+	AreaName         string     `json:"areaName,omitempty"`
+	Text             string     `json:"text,omitempty"`
+	BadChecksum      bool       `json:"badChecksum,omitempty"` // Raw Contact ID failed its mod-15 check
+	Location         *Location  `json:"location,omitempty"`
+	EventTime        *time.Time `json:"eventTime,omitempty"` // Time the panel reports for the event, SignalDateTime is when we got it
+	MAC              string     `json:"mac,omitempty"`
+	VerificationURL  string     `json:"verificationUrl,omitempty"` // Video or image verification of the alarm
+	SiteName         string     `json:"siteName,omitempty"`
+	ProgramData      string     `json:"programData,omitempty"`
+	Snapshots        []string   `json:"snapshots,omitempty"` // Local paths of the images that came with the alarm
+	Replay           bool       `json:"replay,omitempty"`    // Re-run from the frame archive, not a live event
+	RawSignal        string     `json:"rawSignal"`
+}
+
+// Location is a GPS position in decimal degrees, north and east positive.
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
 }
 
 type PhoneSignal struct {
@@ -36,6 +61,8 @@ type PhoneSignal struct {
 	LineNo           string `json:"lineNo"`
 	PhoneNo          string `json:"phoneNo"`
 	MonitoringCenter int    `json:"monitoringCenter"`
+	Replay           bool   `json:"replay,omitempty"`
+	RawSignal        string `json:"rawSignal"`
 }
 
 type PingSignal struct {
@@ -44,6 +71,31 @@ type PingSignal struct {
 	ReceiverId       string `json:"receiverId"`
 	RawSignal        string `json:"rawSignal"`
 	MonitoringCenter int    `json:"monitoringCenter"`
+	Replay           bool   `json:"replay,omitempty"`
+}
+
+// UnparsedType is the type of an AlarmSignal standing for a message that was
+// ACKed but whose event data could not be decoded. It has no event code, the
+// message is in RawSignal for operators to read.
+const UnparsedType = "unparsed"
+
+// IsUnparsed reports whether a signal stands for an undecoded message.
+func IsUnparsed(signal interface{}) bool {
+	alarm, isAlarm := signal.(AlarmSignal)
+	return isAlarm && alarm.Type == UnparsedType
+}
+
+// SignalAccount returns the account (SideNo) a parsed signal belongs to.
+func SignalAccount(signal interface{}) string {
+	switch s := signal.(type) {
+	case AlarmSignal:
+		return s.SideNo
+	case PhoneSignal:
+		return s.SideNo
+	case PingSignal:
+		return s.SideNo
+	}
+	return ""
 }
 
 func SiaEventOrZone(eventZone string) (event string, zone string) {
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"agent/archive"
+	"agent/model"
+	"agent/protocol"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"strings"
+	"time"
+)
+
+/*
+MQTT services subscribe to topics on a broker, for smart sensors and
+gateways that publish their events there. Each topic rule decodes the
+messages of the topics matching its pattern, the first matching rule wins:
+JSON payloads are mapped with fields like the body of an HTTP service, text
+payloads go through a parser, e.g. CID or SIA for bare Contact ID and SIA
+strings. The account may come from a topic level instead of the payload.
+
+	topics:
+	  - pattern: alarms/+/cid   # alarms/1234/cid  "1130 01 003"
+	    format: CID
+	    accountLevel: 2
+	  - pattern: sensors/#      # {"device": "1234", "alarm": "BA", "zone": 4}
+	    fields: {sideNo: device, eventCode: alarm}
+
+Messages are acknowledged to the broker only once published. A message
+that fails to publish is retried in place with the service backoff, up to
+mqttDeliveryAttempts times, since the messages after it wait meanwhile.
+Then QoS 1 and 2 messages are left unacknowledged, the broker delivers
+them again after the next reconnect; QoS 0 messages are dropped, the
+archive keeps them for replay. Messages the parser answers with a NAK,
+like a bad Contact ID checksum with cidChecksum: nak, are acknowledged,
+logged and archived as rejected.
+*/
+
+const (
+	mqttType = "MQTT"
+	jsonType = "JSON" // Payload format of topic rules, mapped with fields as for HTTP services
+
+	defaultMqttPort    = 1883
+	defaultMqttTLSPort = 8883
+
+	mqttDeliveryAttempts = 4
+)
+
+// TopicRule decodes the messages of the topics matching Pattern.
+type TopicRule struct {
+	Pattern      string            `yaml:"pattern"`      // Subscription filter with + and # wildcards, e.g. alarms/+/event
+	Qos          byte              `yaml:"qos"`          // 0, 1 or 2
+	Format       string            `yaml:"format"`       // JSON (default), or the parser of text payloads, e.g. CID, SIA or DC09
+	Fields       map[string]string `yaml:"fields"`       // JSON only: signal field to JSON path, as for HTTP services
+	AccountLevel int               `yaml:"accountLevel"` // Topic level holding the account, 1 for the first; 0 reads it from the payload
+}
+
+// mqttRule is a topic rule with the service settings its payloads are
+// parsed with, and the session its signals are delivered on.
+type mqttRule struct {
+	TopicRule
+	service ServiceConfig
+	session *session
+}
+
+// mqttInput decodes and delivers the messages of one MQTT service.
+type mqttInput struct {
+	service ServiceConfig
+	rules   []*mqttRule
+	deliver func(s *session, signals []interface{}, rawSignal string) error
+}
+
+// newMqttInput validates the topic rules of an MQTT service.
+func newMqttInput(service ServiceConfig) (*mqttInput, error) {
+	if len(service.Topics) == 0 {
+		return nil, errors.New("MQTT services need at least one topic")
+	}
+	in := &mqttInput{service: service, deliver: deliverSignals}
+	for _, topic := range service.Topics {
+		if !validTopicFilter(topic.Pattern) {
+			return nil, fmt.Errorf("invalid topic pattern %q", topic.Pattern)
+		}
+		if topic.Qos > 2 {
+			return nil, fmt.Errorf("topic %s: qos must be 0, 1 or 2", topic.Pattern)
+		}
+		if topic.AccountLevel < 0 {
+			return nil, fmt.Errorf("topic %s: accountLevel must not be negative", topic.Pattern)
+		}
+
+		rule := &mqttRule{TopicRule: topic, service: service}
+		rule.service.Type = topic.Format
+		if rule.service.Type == "" {
+			rule.service.Type = jsonType
+		}
+		rule.service.Fields = topic.Fields
+		if rule.service.Type == jsonType {
+			if err := checkFields(topic.Fields); err != nil {
+				return nil, fmt.Errorf("topic %s: %w", topic.Pattern, err)
+			}
+		} else if _, err := parserFor(rule.service); err != nil {
+			return nil, fmt.Errorf("topic %s: %w", topic.Pattern, err)
+		}
+		rule.session = &session{
+			id:      lastConnId.Add(1),
+			service: rule.service,
+			limiter: accountLimiterFor(service),
+		}
+		in.rules = append(in.rules, rule)
+	}
+	return in, nil
+}
+
+// validTopicFilter checks the wildcards of a subscription: "+" stands for
+// one whole level, "#" for the rest of the topic as its last level.
+func validTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// topicMatches reports whether a topic matches a subscription filter.
+// Wildcards in the first level do not match topics starting with "$".
+func topicMatches(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// rule returns the first rule whose pattern matches topic.
+func (in *mqttInput) rule(topic string) *mqttRule {
+	for _, rule := range in.rules {
+		if topicMatches(rule.Pattern, topic) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// signals decodes one message with its topic rule, ack is the answer of a
+// text parser.
+func (in *mqttInput) signals(rule *mqttRule, topic string, payload []byte) (signals []interface{}, ack string, err error) {
+	account := ""
+	if rule.AccountLevel > 0 {
+		levels := strings.Split(topic, "/")
+		if rule.AccountLevel > len(levels) || levels[rule.AccountLevel-1] == "" {
+			return nil, "", fmt.Errorf("topic %s has no account at level %d", topic, rule.AccountLevel)
+		}
+		account = levels[rule.AccountLevel-1]
+	}
+
+	if rule.service.Type == jsonType {
+		signals, err = webhookSignals(payload, rule.service, account)
+	} else {
+		signals, ack, err = parseFrame(payload, rule.service)
+	}
+	if err != nil || account == "" {
+		return signals, ack, err
+	}
+	// The topic is what the broker lets the device publish to, it wins
+	for i, signal := range signals {
+		signals[i] = withAccount(signal, account)
+	}
+	return signals, ack, nil
+}
+
+func withAccount(signal interface{}, account string) interface{} {
+	switch s := signal.(type) {
+	case model.AlarmSignal:
+		s.SideNo = account
+		return s
+	case model.PhoneSignal:
+		s.SideNo = account
+		return s
+	case model.PingSignal:
+		s.SideNo = account
+		return s
+	}
+	return signal
+}
+
+// onMessage delivers a message and acknowledges it once published. Messages
+// come one at a time, in order, so the messages after one that is retried
+// wait for it, and paho reads nothing from the broker meanwhile.
+func (in *mqttInput) onMessage(client mqtt.Client, msg mqtt.Message) {
+	topic, payload := msg.Topic(), msg.Payload()
+	fmt.Printf("Processing %s data on %s: %s\n", in.service.Type, topic, payload)
+	rule := in.rule(topic)
+	if rule == nil {
+		fmt.Printf("No topic rule of service %s matches %s\n", in.service.Name, topic)
+		msg.Ack()
+		return
+	}
+	s := rule.session
+	s.remote = topic
+
+	signals, ack, err := in.signals(rule, topic, payload)
+	if err == nil && protocol.IsNak(ack) {
+		fmt.Printf("Rejected message on %s for service %s, the %s parser answered NAK\n", topic, in.service.Name, rule.service.Type)
+		s.archive(archive.Received, payload, rxOutcome(ack, signals, nil))
+		msg.Ack()
+		return
+	}
+	if err != nil || len(signals) == 0 {
+		fmt.Printf("Unparsed message on %s for service %s: %v\n", topic, in.service.Name, err)
+		s.archive(archive.Received, payload, "unparsed")
+		msg.Ack()
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		err := in.deliver(s, signals, string(payload))
+		if err == nil {
+			break
+		}
+		if attempt == mqttDeliveryAttempts || (msg.Qos() > 0 && !client.IsConnectionOpen()) {
+			if msg.Qos() > 0 {
+				fmt.Printf("Error delivering message on %s for service %s, left for the broker to send again after reconnecting: %v\n", topic, in.service.Name, err)
+			} else {
+				fmt.Printf("Error delivering QoS 0 message on %s for service %s, dropped after %d attempts, replay it from the archive: %v\n", topic, in.service.Name, attempt, err)
+			}
+			s.archive(archive.Received, payload, "error")
+			return
+		}
+		delay := backoffDelay(in.service.Backoff, attempt-1)
+		fmt.Printf("Error delivering message on %s for service %s, retrying in %s: %v\n", topic, in.service.Name, delay.Round(time.Millisecond), err)
+		time.Sleep(delay)
+	}
+	s.archive(archive.Received, payload, rxOutcome("", signals, nil))
+	msg.Ack()
+}
+
+// subscribe subscribes to the topics of every rule, on each (re)connect.
+func (in *mqttInput) subscribe(client mqtt.Client) {
+	fmt.Printf("Connected to MQTT broker for service %s\n", in.service.Name)
+	for _, rule := range in.rules {
+		token := client.Subscribe(rule.Pattern, rule.Qos, nil)
+		if !token.WaitTimeout(defaultDialTimeout) {
+			fmt.Printf("Subscribing to %s for service %s timed out\n", rule.Pattern, in.service.Name)
+		} else if err := token.Error(); err != nil {
+			fmt.Printf("Error subscribing to %s for service %s: %v\n", rule.Pattern, in.service.Name, err)
+		}
+	}
+}
+
+// clientOptions builds the broker connection of the service: its hosts in
+// order, credentials, TLS and reconnect backoff. The session is kept by the
+// broker while we are away.
+func (in *mqttInput) clientOptions() (*mqtt.ClientOptions, error) {
+	service := in.service
+	scheme, port := "tcp", defaultMqttPort
+	if service.TLS.Enabled {
+		scheme, port = "ssl", defaultMqttTLSPort
+	}
+	if service.Port == 0 {
+		service.Port = port
+	}
+	opts := mqtt.NewClientOptions()
+	targets := connectorTargets(service)
+	for _, target := range targets {
+		opts.AddBroker(scheme + "://" + target)
+	}
+	if service.TLS.Enabled {
+		tlsConfig, err := clientTLSConfig(service, targets[0])
+		if err != nil {
+			return nil, err
+		}
+		if service.TLS.ServerName == "" {
+			tlsConfig.ServerName = "" // Each broker is checked against its own host name
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	clientId := service.ClientId
+	if clientId == "" {
+		clientId = "agent-" + service.Name
+	}
+	dialTimeout := service.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	backoffMin, backoffMax := service.Backoff.Min, service.Backoff.Max
+	if backoffMin <= 0 {
+		backoffMin = defaultBackoffMin
+	}
+	if backoffMax < backoffMin {
+		backoffMax = max(defaultBackoffMax, backoffMin)
+	}
+
+	opts.SetClientID(clientId).
+		SetUsername(service.Username).
+		SetPassword(service.Password).
+		SetCleanSession(false).
+		SetOrderMatters(true).
+		SetAutoAckDisabled(true).
+		SetConnectTimeout(dialTimeout).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(backoffMin).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(backoffMax).
+		SetDefaultPublishHandler(in.onMessage).
+		SetOnConnectHandler(in.subscribe).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			fmt.Printf("Lost MQTT broker for service %s, reconnecting: %v\n", service.Name, err)
+		})
+	if service.KeepAlive > 0 {
+		opts.SetKeepAlive(service.KeepAlive)
+	}
+	return opts, nil
+}
+
+// connect connects to the broker and waits up to timeout for the first
+// connection; the client keeps retrying in the background after that.
+func (in *mqttInput) connect(timeout time.Duration) (mqtt.Client, error) {
+	opts, err := in.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(timeout) {
+		return client, fmt.Errorf("not connected after %s, still retrying", timeout)
+	}
+	return client, token.Error()
+}
+
+func startMqtt(service ServiceConfig) {
+	in, err := newMqttInput(service)
+	if err != nil {
+		fmt.Printf("Invalid MQTT service %s: %v\n", service.Name, err)
+		return
+	}
+	if _, err := in.connect(defaultDialTimeout); err != nil {
+		fmt.Printf("Error connecting to MQTT broker for service %s: %v\n", service.Name, err)
+	}
+}
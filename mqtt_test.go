@@ -0,0 +1,239 @@
+package main
+
+import (
+	"agent/model"
+	"errors"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var mqttService = ServiceConfig{
+	Name: "Sensors",
+	Id:   9,
+	Type: mqttType,
+	Topics: []TopicRule{
+		{Pattern: "alarms/+/cid", Format: "CID", AccountLevel: 2, Qos: 1},
+		{Pattern: "alarms/+/sia", Format: "SIA", AccountLevel: 2, Qos: 1},
+		{Pattern: "sensors/#", Fields: map[string]string{"sideNo": "device", "eventCode": "alarm"}, Qos: 1},
+	},
+}
+
+func TestTopicMatches(t *testing.T) {
+	for _, tt := range []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"alarms/+/cid", "alarms/1234/cid", true},
+		{"alarms/+/cid", "alarms/1234/sia", false},
+		{"alarms/+/cid", "alarms/1234/cid/extra", false},
+		{"alarms/+/cid", "alarms/cid", false},
+		{"sensors/#", "sensors", true},
+		{"sensors/#", "sensors/hall/pir", true},
+		{"sensors/#", "sensorsx/hall", false},
+		{"#", "anything/at/all", true},
+		{"#", "$SYS/broker/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"a//b", "a//b", true},
+	} {
+		if got := topicMatches(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("topicMatches(%q, %q) = %t, want %t", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestNewMqttInputRejected(t *testing.T) {
+	for _, topics := range [][]TopicRule{
+		nil,
+		{{Pattern: ""}},
+		{{Pattern: "alarms/#/cid"}},
+		{{Pattern: "alarms/a+/cid"}},
+		{{Pattern: "alarms", Qos: 3}},
+		{{Pattern: "alarms", AccountLevel: -1}},
+		{{Pattern: "alarms", Format: "NOPE"}},
+		{{Pattern: "alarms", Fields: map[string]string{"account": "device"}}},
+	} {
+		service := mqttService
+		service.Topics = topics
+		if _, err := newMqttInput(service); err == nil {
+			t.Errorf("topics %+v accepted", topics)
+		}
+	}
+}
+
+func TestMqttSignals(t *testing.T) {
+	in, err := newMqttInput(mqttService)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		topic, payload  string
+		account, event  string
+		zone            string
+		wantErrOrSilent bool
+	}{
+		{"alarms/1234/cid", "1130 01 003", "1234", "E130", "003", false},
+		// The topic wins over the account in the payload
+		{"alarms/1234/cid", "#9999|3401 02 012", "1234", "R401", "012", false},
+		{"alarms/5678/sia", "Nri1/BA004", "5678", "BA", "004", false},
+		{"sensors/hall/pir", `{"device": "4321", "alarm": "BA", "zone": 7}`, "4321", "BA", "7", false},
+		{"sensors/hall/pir", `{"alarm": "BA"}`, "", "", "", true},
+		{"alarms/1234/cid", "not contact id", "", "", "", true},
+	} {
+		rule := in.rule(tt.topic)
+		if rule == nil {
+			t.Fatalf("no rule for %s", tt.topic)
+		}
+		signals, _, err := in.signals(rule, tt.topic, []byte(tt.payload))
+		if tt.wantErrOrSilent {
+			if err == nil && len(signals) > 0 {
+				t.Errorf("%s %q: got %+v", tt.topic, tt.payload, signals)
+			}
+			continue
+		}
+		if err != nil || len(signals) != 1 {
+			t.Fatalf("%s %q: %v, %v", tt.topic, tt.payload, signals, err)
+		}
+		alarm := signals[0].(model.AlarmSignal)
+		if alarm.SideNo != tt.account || alarm.EventCode != tt.event || alarm.Zone != tt.zone || alarm.ReceiverId != "9" {
+			t.Errorf("%s %q: got %+v", tt.topic, tt.payload, alarm)
+		}
+	}
+}
+
+// testMessage is a received MQTT message that records its acknowledgement.
+type testMessage struct {
+	topic   string
+	payload string
+	qos     byte
+	acked   bool
+}
+
+func (m *testMessage) Duplicate() bool   { return false }
+func (m *testMessage) Qos() byte         { return m.qos }
+func (m *testMessage) Retained() bool    { return false }
+func (m *testMessage) Topic() string     { return m.topic }
+func (m *testMessage) MessageID() uint16 { return 1 }
+func (m *testMessage) Payload() []byte   { return []byte(m.payload) }
+func (m *testMessage) Ack()              { m.acked = true }
+
+// testClient is a broker connection that is open or lost.
+type testClient struct {
+	mqtt.Client
+	open bool
+}
+
+func (c testClient) IsConnectionOpen() bool { return c.open }
+
+func TestMqttDeliveryRetried(t *testing.T) {
+	service := mqttService
+	service.Backoff = BackoffConfig{Min: time.Millisecond, Max: 2 * time.Millisecond}
+	for _, tt := range []struct {
+		name      string
+		qos       byte
+		open      bool
+		failures  int
+		wantTries int
+		wantAcked bool
+	}{
+		{"delivered", 1, true, 0, 1, true},
+		{"retried while connected", 1, true, 2, 3, true},
+		{"left to the broker after the last attempt", 1, true, 10, mqttDeliveryAttempts, false},
+		{"left to the broker after the connection is lost", 1, false, 3, 1, false},
+		{"qos 0 retried after the connection is lost", 0, false, 2, 3, true},
+		{"qos 0 dropped after the last attempt", 0, true, 10, mqttDeliveryAttempts, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			in, err := newMqttInput(service)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tries := 0
+			in.deliver = func(s *session, signals []interface{}, rawSignal string) error {
+				if tries++; tries <= tt.failures {
+					return errors.New("pubsub down")
+				}
+				return nil
+			}
+			msg := &testMessage{topic: "alarms/1234/cid", payload: "1130 01 003", qos: tt.qos}
+			in.onMessage(testClient{open: tt.open}, msg)
+			if tries != tt.wantTries || msg.acked != tt.wantAcked {
+				t.Errorf("tried %d times, acked %t; want %d, %t", tries, msg.acked, tt.wantTries, tt.wantAcked)
+			}
+		})
+	}
+}
+
+func TestMqttNak(t *testing.T) {
+	service := mqttService
+	service.Name, service.CidChecksum = "Sensors nak", "nak"
+	in, err := newMqttInput(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.deliver = func(s *session, signals []interface{}, rawSignal string) error {
+		t.Errorf("delivered %+v", signals)
+		return nil
+	}
+	// A raw Contact ID message failing its checksum
+	msg := &testMessage{topic: "alarms/1234/cid", payload: "1234181130010031", qos: 1}
+	in.onMessage(testClient{open: true}, msg)
+	if !msg.acked {
+		t.Error("rejected message left for redelivery")
+	}
+}
+
+// TestMqttBroker runs against a local broker, e.g. mosquitto, when
+// MQTT_BROKER is set to its host:port.
+func TestMqttBroker(t *testing.T) {
+	broker := os.Getenv("MQTT_BROKER")
+	if broker == "" {
+		t.Skip("MQTT_BROKER is not set")
+	}
+	host, port, err := net.SplitHostPort(broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := mqttService
+	service.Hosts = []string{host}
+	service.Port, _ = strconv.Atoi(port)
+	service.ClientId = "agent-test-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	in, err := newMqttInput(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered := make(chan []interface{}, 1)
+	in.deliver = func(s *session, signals []interface{}, rawSignal string) error {
+		delivered <- signals
+		return nil
+	}
+	client, err := in.connect(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(100)
+
+	publisher := mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://" + broker))
+	if token := publisher.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("publisher: %v", token.Error())
+	}
+	defer publisher.Disconnect(100)
+
+	// Subscriptions are made right after connecting, give them a moment
+	time.Sleep(500 * time.Millisecond)
+	publisher.Publish("alarms/1234/cid", 1, false, "1130 01 003").Wait()
+	select {
+	case signals := <-delivered:
+		if alarm := signals[0].(model.AlarmSignal); alarm.SideNo != "1234" || alarm.EventCode != "E130" {
+			t.Errorf("delivered %+v", alarm)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing delivered")
+	}
+}
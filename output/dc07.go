@@ -0,0 +1,70 @@
+package output
+
+import (
+	"agent/model"
+	"agent/protocol"
+	"bufio"
+	"fmt"
+)
+
+// dc07 emits SIA DC-07, see protocol.Dc07Message. Contact ID and SIA alarms
+// are sent as ADM-CID and SIA-DCS messages, the heartbeat is a NULL message.
+// Accounts take up to 16 hex digits, longer fields and other event codes are
+// skipped as for MLR2.
+type dc07 struct {
+	config Config
+}
+
+func newDc07(config Config) format {
+	return dc07{config: config}
+}
+
+func (f dc07) record(signal interface{}, seq int) ([]byte, bool) {
+	alarm, isAlarm := signal.(model.AlarmSignal)
+	if !isAlarm {
+		return nil, false
+	}
+	account, lineNo := alarm.SideNo, line(f.config, alarm.ReceiverId)
+	switch {
+	case cidCode.MatchString(alarm.EventCode):
+		if !cidFits(alarm, 16) {
+			return skip(f.config, "Contact ID alarm", alarm)
+		}
+		qualifier := "1"
+		if alarm.EventCode[0] == 'R' {
+			qualifier = "3"
+		}
+		data := fmt.Sprintf("#%s|%s%s %02s %03s", account, qualifier, alarm.EventCode[1:], alarm.PartNo, alarm.Zone)
+		return []byte(protocol.Dc07Message("ADM-CID", seq, f.config.Receiver, lineNo, account, data)), true
+	case siaCode.MatchString(alarm.EventCode):
+		if !siaFits(alarm) {
+			return skip(f.config, "SIA alarm", alarm)
+		}
+		area := alarm.PartNo
+		if area == "" {
+			area = "0"
+		}
+		data := fmt.Sprintf("#%s|Nri%s/%s%s", account, area, alarm.EventCode, alarm.Zone)
+		return []byte(protocol.Dc07Message("SIA-DCS", seq, f.config.Receiver, lineNo, account, data)), true
+	}
+	return skip(f.config, fmt.Sprintf("event code %q", alarm.EventCode), alarm)
+}
+
+func (f dc07) heartbeat(seq int) []byte {
+	return []byte(protocol.Dc07Message("NULL", seq, f.config.Receiver, 0, "0", ""))
+}
+
+// reply reads answers up to the one for seq; answers to earlier messages,
+// late after a retransmission, are skipped.
+func (f dc07) reply(r *bufio.Reader, seq int) (bool, error) {
+	want := (seq-1)%9999 + 1
+	for {
+		text, err := r.ReadString('\r')
+		if err != nil {
+			return false, err
+		}
+		if ack, replySeq, ok := protocol.ParseDc07Reply(text); ok && replySeq == want {
+			return ack, nil
+		}
+	}
+}
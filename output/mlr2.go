@@ -0,0 +1,144 @@
+package output
+
+import (
+	"agent/model"
+	"bufio"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+Sur-Gard MLR2 / System III computer output, the records our SURGUARD
+parser reads. Every record ends with DC4 (0x14) and waits for ACK (0x06);
+NAK (0x15) asks for it again.
+
+	Contact ID   5RRLLL 18AAAAQEEEGGCCC   501001 181234E13001003
+	SIA          SRRLLL[#AAAA|NriG/CCZZZ] S01001[#1234|Nri1/BA004]
+	Phone        4RRLLL AAAATTTTTTTTTT    401001 12342128034294
+	Heartbeat    1RRL           @         1011           @
+
+Contact ID and phone records have room for 4 account digits, SIA records
+for 16. Signals with a longer account, partition or zone, like 6 digit OH
+accounts or device MACs, have no record and are counted as skipped. So do
+alarms with other event codes, like Contact ID status reports (6xxx) or our
+own RUNAWAY signals.
+*/
+
+const (
+	mlr2End = 0x14
+	mlr2Ack = 0x06
+	mlr2Nak = 0x15
+)
+
+var (
+	cidCode = regexp.MustCompile(`^[ER][0-9A-Fa-f]{3}$`)
+	siaCode = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+// hexField reports whether value is a hex number of min to max digits.
+func hexField(value string, min, max int) bool {
+	if len(value) < min || len(value) > max {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if !strings.ContainsRune("0123456789ABCDEFabcdef", rune(value[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+// cidFits reports whether the account, partition and zone of a Contact ID
+// alarm fit their fields, padded with zeros.
+func cidFits(s model.AlarmSignal, accountDigits int) bool {
+	return hexField(s.SideNo, 1, accountDigits) && hexField(s.PartNo, 0, 2) && hexField(s.Zone, 0, 3)
+}
+
+// siaFits reports whether a SIA alarm can be written as "#account|NriG/CCZZZ".
+func siaFits(s model.AlarmSignal) bool {
+	return hexField(s.SideNo, 1, 16) && hexField(s.PartNo, 0, 4) && hexField(s.Zone, 0, 4)
+}
+
+// skip counts a signal the output has no room for.
+func skip(config Config, what string, signal interface{}) ([]byte, bool) {
+	fmt.Printf("Output %s: %s does not fit a %s record, skipped: %+v\n", config.Name, what, config.Type, signal)
+	records.Add(config.Name+"/skipped", 1)
+	return nil, false
+}
+
+type mlr2 struct {
+	config Config
+}
+
+func newMlr2(config Config) format {
+	return mlr2{config: config}
+}
+
+// line is the line number of a signal: the configured one, or the id of the
+// input service the signal came in on.
+func line(config Config, receiverId string) int {
+	if config.Line > 0 {
+		return config.Line
+	}
+	if id, err := strconv.Atoi(receiverId); err == nil && id > 0 {
+		return id
+	}
+	return 1
+}
+
+func (f mlr2) record(signal interface{}, seq int) ([]byte, bool) {
+	var text string
+	switch s := signal.(type) {
+	case model.AlarmSignal:
+		head := fmt.Sprintf("%02d%03d", f.config.Receiver%100, line(f.config, s.ReceiverId)%1000)
+		switch {
+		case cidCode.MatchString(s.EventCode):
+			if !cidFits(s, 4) {
+				return skip(f.config, "Contact ID alarm", s)
+			}
+			text = fmt.Sprintf("5%s 18%04s%s%02s%03s", head, s.SideNo, strings.ToUpper(s.EventCode), s.PartNo, s.Zone)
+		case siaCode.MatchString(s.EventCode):
+			if !siaFits(s) {
+				return skip(f.config, "SIA alarm", s)
+			}
+			area := s.PartNo
+			if area == "" {
+				area = "0"
+			}
+			text = fmt.Sprintf("S%s[#%s|Nri%s/%s%s]", head, s.SideNo, area, s.EventCode, s.Zone)
+		default:
+			return skip(f.config, fmt.Sprintf("event code %q", s.EventCode), s)
+		}
+	case model.PhoneSignal:
+		if !hexField(s.SideNo, 1, 4) {
+			return skip(f.config, "phone report", s)
+		}
+		head := fmt.Sprintf("%02d%03d", f.config.Receiver%100, line(f.config, s.ReceiverId)%1000)
+		text = fmt.Sprintf("4%s %04s%s", head, s.SideNo, s.PhoneNo)
+	default:
+		// Panel heartbeats stay here, the automation gets ours
+		return nil, false
+	}
+	return append([]byte(text), mlr2End), true
+}
+
+func (f mlr2) heartbeat(seq int) []byte {
+	return append([]byte(fmt.Sprintf("1%02d1           @", f.config.Receiver%100)), mlr2End)
+}
+
+func (f mlr2) reply(r *bufio.Reader, seq int) (bool, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return false, err
+		}
+		switch b {
+		case mlr2Ack:
+			return true, nil
+		case mlr2Nak:
+			return false, nil
+		}
+	}
+}
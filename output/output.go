@@ -0,0 +1,253 @@
+// Package output forwards the normalized signals of every input to
+// automation software in the protocol it speaks, e.g. as a virtual Sur-Gard
+// MLR2 receiver. Each channel queues records until they are acknowledged, so
+// nothing is lost while the automation is offline or slow.
+package output
+
+import (
+	"bufio"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHeartbeat  = 30 * time.Second
+	defaultAckTimeout = 4 * time.Second
+	defaultRetries    = 3
+	defaultQueueSize  = 10000
+	defaultReceiver   = 1
+)
+
+// Record counters by "<output name>/<outcome>": acked, retried, failed,
+// dropped, and skipped for signals that do not fit the output's records.
+var records = expvar.NewMap("outputRecords")
+
+type Config struct {
+	Name       string        `yaml:"name"`
+	Type       string        `yaml:"type"`       // MLR2, DC07 or XML
+	Listen     string        `yaml:"listen"`     // Address the automation software connects to, e.g. :1025
+	Receiver   int           `yaml:"receiver"`   // Receiver number in the records, default 1
+	Line       int           `yaml:"line"`       // Line number in the records, default the id of the input service
+	Heartbeat  time.Duration `yaml:"heartbeat"`  // Idle time before a heartbeat, default 30s, negative disables
+	AckTimeout time.Duration `yaml:"ackTimeout"` // Wait for each ACK, default 4s
+	Retries    int           `yaml:"retries"`    // Retransmissions before the connection is dropped, default 3
+	QueueSize  int           `yaml:"queueSize"`  // Records kept while unacknowledged, default 10000; the oldest go first
+}
+
+// format turns signals into the records of one automation protocol and reads
+// its acknowledgements. Sequence numbers count every record and heartbeat
+// sent; a retransmission keeps its number.
+type format interface {
+	record(signal interface{}, seq int) ([]byte, bool)
+	heartbeat(seq int) []byte
+	// reply reads the answer to the record seq: true for ACK, false for NAK
+	reply(r *bufio.Reader, seq int) (bool, error)
+}
+
+// formats builds the format of each output type.
+var formats = map[string]func(Config) format{
+	"MLR2": newMlr2,
+	"DC07": newDc07,
+	"XML":  newXml,
+}
+
+type pending struct {
+	data []byte
+	seq  int
+}
+
+// Channel is one output: a queue of records and the connection of the
+// automation software they are delivered to, one at a time.
+type Channel struct {
+	config Config
+	format format
+
+	mu    sync.Mutex
+	queue []pending
+	seq   int
+	wake  chan struct{} // Closed and replaced when the queue or connection changes
+	conn  net.Conn      // Current automation connection, a new one replaces it
+}
+
+// New validates an output configuration and fills in its defaults.
+func New(config Config) (*Channel, error) {
+	newFormat, exists := formats[config.Type]
+	if !exists {
+		return nil, fmt.Errorf("output %s: unknown type %q", config.Name, config.Type)
+	}
+	if config.Listen == "" {
+		return nil, fmt.Errorf("output %s: listen address is required", config.Name)
+	}
+	if config.Receiver == 0 {
+		config.Receiver = defaultReceiver
+	}
+	if config.Heartbeat == 0 {
+		config.Heartbeat = defaultHeartbeat
+	}
+	if config.AckTimeout <= 0 {
+		config.AckTimeout = defaultAckTimeout
+	}
+	if config.Retries <= 0 {
+		config.Retries = defaultRetries
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultQueueSize
+	}
+	return &Channel{
+		config: config,
+		format: newFormat(config),
+		wake:   make(chan struct{}),
+	}, nil
+}
+
+// Send queues the signals the format has a record for. It never blocks; when
+// the queue is full the oldest records are dropped.
+func (ch *Channel) Send(signals []interface{}) {
+	ch.mu.Lock()
+	for _, signal := range signals {
+		ch.seq++
+		data, ok := ch.format.record(signal, ch.seq)
+		if !ok {
+			ch.seq--
+			continue
+		}
+		if len(ch.queue) == ch.config.QueueSize {
+			ch.queue = ch.queue[1:]
+			records.Add(ch.config.Name+"/dropped", 1)
+		}
+		ch.queue = append(ch.queue, pending{data: data, seq: ch.seq})
+	}
+	ch.wakeUp()
+	ch.mu.Unlock()
+}
+
+// wakeUp tells the waiting deliver loops to look again; ch.mu must be held.
+func (ch *Channel) wakeUp() {
+	close(ch.wake)
+	ch.wake = make(chan struct{})
+}
+
+// Queued returns the number of records waiting for an ACK.
+func (ch *Channel) Queued() int {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return len(ch.queue)
+}
+
+// Run accepts automation connections on the configured address and delivers
+// the queue to the newest one. It returns only when listening fails.
+func (ch *Channel) Run() error {
+	listener, err := net.Listen("tcp", ch.config.Listen)
+	if err != nil {
+		return err
+	}
+	return ch.Serve(listener)
+}
+
+// Serve is Run on an existing listener.
+func (ch *Channel) Serve(listener net.Listener) error {
+	fmt.Printf("Output %s (%s) listening on %s\n", ch.config.Name, ch.config.Type, listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Output %s: automation connected from %s\n", ch.config.Name, conn.RemoteAddr())
+
+		ch.mu.Lock()
+		if ch.conn != nil {
+			ch.conn.Close()
+		}
+		ch.conn = conn
+		ch.wakeUp()
+		ch.mu.Unlock()
+
+		go func() {
+			err := ch.deliver(conn)
+			conn.Close()
+			fmt.Printf("Output %s: automation %s disconnected: %v\n", ch.config.Name, conn.RemoteAddr(), err)
+		}()
+	}
+}
+
+// deliver sends the queue head until it is acknowledged, and a heartbeat
+// whenever the queue has been empty for the heartbeat interval.
+func (ch *Channel) deliver(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	for {
+		next, isRecord, err := ch.next(conn)
+		if err != nil {
+			return err
+		}
+
+		acked := false
+		for try := 0; try <= ch.config.Retries && !acked; try++ {
+			if try > 0 {
+				records.Add(ch.config.Name+"/retried", 1)
+			}
+			conn.SetWriteDeadline(time.Now().Add(ch.config.AckTimeout))
+			if _, err := conn.Write(next.data); err != nil {
+				return err
+			}
+			conn.SetReadDeadline(time.Now().Add(ch.config.AckTimeout))
+			acked, err = ch.format.reply(r, next.seq)
+			var netErr net.Error
+			if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+				return err
+			}
+		}
+		if !acked {
+			records.Add(ch.config.Name+"/failed", 1)
+			return fmt.Errorf("no ACK after %d retries", ch.config.Retries)
+		}
+
+		if isRecord {
+			records.Add(ch.config.Name+"/acked", 1)
+			ch.mu.Lock()
+			if len(ch.queue) > 0 && ch.queue[0].seq == next.seq {
+				ch.queue = ch.queue[1:]
+			}
+			ch.mu.Unlock()
+		}
+	}
+}
+
+// next waits for the queue head, or returns a heartbeat after the heartbeat
+// interval without records. It fails once conn is no longer the current one.
+func (ch *Channel) next(conn net.Conn) (pending, bool, error) {
+	var timeout <-chan time.Time
+	if ch.config.Heartbeat > 0 {
+		timer := time.NewTimer(ch.config.Heartbeat)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		ch.mu.Lock()
+		if ch.conn != conn {
+			ch.mu.Unlock()
+			return pending{}, false, os.ErrClosed
+		}
+		if len(ch.queue) > 0 {
+			head := ch.queue[0]
+			ch.mu.Unlock()
+			return head, true, nil
+		}
+		wake := ch.wake
+		ch.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-timeout:
+			ch.mu.Lock()
+			ch.seq++
+			beat := pending{data: ch.format.heartbeat(ch.seq), seq: ch.seq}
+			ch.mu.Unlock()
+			return beat, false, nil
+		}
+	}
+}
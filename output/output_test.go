@@ -0,0 +1,242 @@
+package output
+
+import (
+	"agent/model"
+	"agent/protocol"
+	"bufio"
+	"encoding/xml"
+	"net"
+	"testing"
+	"time"
+)
+
+// automation connects to a channel like the automation software would.
+func automation(t *testing.T, config Config) (*Channel, net.Conn, *bufio.Reader) {
+	t.Helper()
+	config.Listen = "127.0.0.1:0"
+	ch, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go ch.Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return ch, conn, bufio.NewReader(conn)
+}
+
+func readRecord(t *testing.T, r *bufio.Reader, end byte) string {
+	t.Helper()
+	record, err := r.ReadString(end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestMlr2(t *testing.T) {
+	ch, conn, r := automation(t, Config{Name: "test", Type: "MLR2", Heartbeat: -1})
+	ch.Send([]interface{}{
+		model.AlarmSignal{SideNo: "1234", ReceiverId: "6", EventCode: "E130", PartNo: "1", Zone: "3"},
+		model.PingSignal{Type: "ping", SideNo: "1234"},
+		model.AlarmSignal{SideNo: "1234", ReceiverId: "6", EventCode: "BA", PartNo: "1", Zone: "004"},
+	})
+
+	cid := "501006 181234E13001003\x14"
+	if got := readRecord(t, r, mlr2End); got != cid {
+		t.Fatalf("record %q, want %q", got, cid)
+	}
+	conn.Write([]byte{mlr2Nak})
+	if got := readRecord(t, r, mlr2End); got != cid {
+		t.Fatalf("after NAK %q, want the record again", got)
+	}
+	conn.Write([]byte{mlr2Ack})
+
+	sia := "S01006[#1234|Nri1/BA004]\x14"
+	if got := readRecord(t, r, mlr2End); got != sia {
+		t.Fatalf("record %q, want %q", got, sia)
+	}
+	conn.Write([]byte{mlr2Ack})
+
+	deadline := time.Now().Add(time.Second)
+	for ch.Queued() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := ch.Queued(); n != 0 {
+		t.Errorf("%d records still queued", n)
+	}
+}
+
+func TestMlr2FieldWidths(t *testing.T) {
+	ch, conn, r := automation(t, Config{Name: "widths", Type: "MLR2", Heartbeat: -1})
+	ch.Send([]interface{}{
+		model.AlarmSignal{SideNo: "123456", ReceiverId: "1", EventCode: "E130", PartNo: "01", Zone: "003"},       // OH, Radionics
+		model.AlarmSignal{SideNo: "001bc50a1234", ReceiverId: "1", EventCode: "E130", PartNo: "01", Zone: "003"}, // ISAPI MAC
+		model.AlarmSignal{SideNo: "1234", ReceiverId: "1", EventCode: "E130", PartNo: "101", Zone: "003"},
+		model.AlarmSignal{SideNo: "1234", ReceiverId: "1", EventCode: "E130", PartNo: "01", Zone: "1003"},
+		model.AlarmSignal{SideNo: "home/1234", ReceiverId: "1", EventCode: "BA", Zone: "3"}, // MQTT topic
+		model.PhoneSignal{SideNo: "123456", ReceiverId: "1", PhoneNo: "2128034294"},
+		model.AlarmSignal{SideNo: "001bc50a1234", ReceiverId: "1", EventCode: "BA", PartNo: "1", Zone: "3"},
+		model.AlarmSignal{SideNo: "12", ReceiverId: "1", EventCode: "R401", PartNo: "1", Zone: "7"},
+	})
+
+	for _, want := range []string{"S01001[#001bc50a1234|Nri1/BA3]\x14", "501001 180012R40101007\x14"} {
+		if got := readRecord(t, r, mlr2End); got != want {
+			t.Fatalf("record %q, want %q", got, want)
+		}
+		conn.Write([]byte{mlr2Ack})
+	}
+	if got := records.Get("widths/skipped"); got == nil || got.String() != "6" {
+		t.Errorf("skipped %v, want 6", got)
+	}
+}
+
+func TestMlr2EventCodes(t *testing.T) {
+	ch, conn, r := automation(t, Config{Name: "codes", Type: "MLR2", Heartbeat: -1})
+	ch.Send([]interface{}{
+		model.AlarmSignal{SideNo: "1234", ReceiverId: "1", EventCode: "6130", PartNo: "01", Zone: "003"}, // Status report
+		model.AlarmSignal{SideNo: "1234", ReceiverId: "1", EventCode: "31"},                              // Radionics
+		model.AlarmSignal{SideNo: "1234", ReceiverId: "1", EventCode: "RUNAWAY"},
+		model.AlarmSignal{SideNo: "1234", ReceiverId: "1", EventCode: "E130", PartNo: "01", Zone: "003"},
+	})
+
+	if got, want := readRecord(t, r, mlr2End), "501001 181234E13001003\x14"; got != want {
+		t.Fatalf("record %q, want %q", got, want)
+	}
+	conn.Write([]byte{mlr2Ack})
+	if got := records.Get("codes/skipped"); got == nil || got.String() != "3" {
+		t.Errorf("skipped %v, want 3", got)
+	}
+}
+
+func TestMlr2Heartbeat(t *testing.T) {
+	_, conn, r := automation(t, Config{Name: "test", Type: "MLR2", Heartbeat: 50 * time.Millisecond})
+	for i := 0; i < 2; i++ {
+		if got, want := readRecord(t, r, mlr2End), "1011           @\x14"; got != want {
+			t.Fatalf("heartbeat %q, want %q", got, want)
+		}
+		conn.Write([]byte{mlr2Ack})
+	}
+}
+
+func TestMlr2Retransmit(t *testing.T) {
+	ch, _, r := automation(t, Config{Name: "test", Type: "MLR2", Heartbeat: -1, AckTimeout: 50 * time.Millisecond, Retries: 2})
+	ch.Send([]interface{}{model.AlarmSignal{SideNo: "1234", ReceiverId: "1", EventCode: "E130", PartNo: "01", Zone: "003"}})
+
+	// Unanswered: sent once and retried twice, then the connection is dropped
+	// and the record stays queued for the next one
+	for i := 0; i < 3; i++ {
+		readRecord(t, r, mlr2End)
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Error("connection still open after the retries")
+	}
+	if n := ch.Queued(); n != 1 {
+		t.Errorf("%d records queued, want 1", n)
+	}
+}
+
+func TestDc07(t *testing.T) {
+	ch, conn, r := automation(t, Config{Name: "test", Type: "DC07", Receiver: 2, Heartbeat: -1})
+	ch.Send([]interface{}{model.AlarmSignal{SideNo: "1234", ReceiverId: "6", EventCode: "R130", PartNo: "01", Zone: "003"}})
+
+	record := readRecord(t, r, '\r')
+	if want := "\n\"ADM-CID\"0001R2L6#1234[#1234|3130 01 003]\r"; record != want {
+		t.Fatalf("record %q, want %q", record, want)
+	}
+	// A receiver chained behind us reads it back with the DC07 parser
+	signals, ack, err := protocol.ParseDc07(record[:len(record)-1], "1")
+	if err != nil || len(signals) != 1 || signals[0].(model.AlarmSignal).EventCode != "R130" {
+		t.Fatalf("parsed back as %v, %v", signals, err)
+	}
+
+	conn.Write([]byte("\n\"NAK\"0001\r"))
+	if again := readRecord(t, r, '\r'); again != record {
+		t.Fatalf("after NAK %q, want the record again", again)
+	}
+	conn.Write([]byte(ack))
+	deadline := time.Now().Add(time.Second)
+	for ch.Queued() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := ch.Queued(); n != 0 {
+		t.Errorf("%d records still queued", n)
+	}
+}
+
+func TestDc07FieldWidths(t *testing.T) {
+	ch, _, r := automation(t, Config{Name: "dc07 widths", Type: "DC07", Heartbeat: -1})
+	ch.Send([]interface{}{
+		model.AlarmSignal{SideNo: "home/1234", ReceiverId: "1", EventCode: "E130", PartNo: "01", Zone: "003"},
+		model.AlarmSignal{SideNo: "1234", ReceiverId: "1", EventCode: "E130", PartNo: "01", Zone: "1003"},
+		model.AlarmSignal{SideNo: "001bc50a1234", ReceiverId: "1", EventCode: "E130", PartNo: "01", Zone: "003"},
+	})
+
+	want := "\n\"ADM-CID\"0001R1L1#001bc50a1234[#001bc50a1234|1130 01 003]\r"
+	if got := readRecord(t, r, '\r'); got != want {
+		t.Fatalf("record %q, want %q", got, want)
+	}
+	if got := records.Get("dc07 widths/skipped"); got == nil || got.String() != "2" {
+		t.Errorf("skipped %v, want 2", got)
+	}
+}
+
+func TestDc07EventCodes(t *testing.T) {
+	ch, _, r := automation(t, Config{Name: "dc07 codes", Type: "DC07", Heartbeat: -1})
+	ch.Send([]interface{}{
+		model.AlarmSignal{SideNo: "1234", ReceiverId: "1", EventCode: "6130", PartNo: "01", Zone: "003"}, // Status report
+		model.AlarmSignal{SideNo: "1234", ReceiverId: "1", EventCode: "RUNAWAY_END"},
+		model.AlarmSignal{SideNo: "1234", ReceiverId: "1", EventCode: "BA", PartNo: "1", Zone: "004"},
+	})
+
+	want := "\n\"SIA-DCS\"0001R1L1#1234[#1234|Nri1/BA004]\r"
+	if got := readRecord(t, r, '\r'); got != want {
+		t.Fatalf("record %q, want %q", got, want)
+	}
+	if got := records.Get("dc07 codes/skipped"); got == nil || got.String() != "2" {
+		t.Errorf("skipped %v, want 2", got)
+	}
+}
+
+func TestXml(t *testing.T) {
+	ch, conn, r := automation(t, Config{Name: "test", Type: "XML", Heartbeat: -1})
+	signalTime := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	ch.Send([]interface{}{model.AlarmSignal{SideNo: "1234", ReceiverId: "3", EventCode: "E130", PartNo: "01", Zone: "003",
+		ZoneName: "Kitchen & hall", SignalDateTime: signalTime, RawSignal: "5 01 1234\n<raw>",
+		Location: &model.Location{Latitude: 41.01512, Longitude: 28.97953}, VerificationURL: "https://nvr.example/clip/81?ch=2&t=1"}})
+
+	record := readRecord(t, r, xmlEnd)
+	var doc xmlSignal
+	if err := xml.Unmarshal([]byte(record), &doc); err != nil {
+		t.Fatalf("record %q: %v", record, err)
+	}
+	if doc.Seq != 1 || doc.Account != "1234" || doc.Event != "E130" || doc.Zone != "003" || doc.Partition != "01" ||
+		doc.ZoneName != "Kitchen & hall" || doc.Line != 3 || doc.SignalTime != "2024-05-01T10:30:00Z" ||
+		doc.ReceivedTime == "" || doc.Raw != "5 01 1234\n<raw>" || doc.Location == nil || doc.Location.Latitude != 41.01512 ||
+		doc.Verification != "https://nvr.example/clip/81?ch=2&t=1" {
+		t.Fatalf("record decoded as %+v", doc)
+	}
+
+	// A late answer to another document does not count
+	conn.Write([]byte("<Ack seq=\"7\"/>\n<Nak seq=\"1\"/>\n"))
+	if again := readRecord(t, r, xmlEnd); again != record {
+		t.Fatalf("after NAK %q, want the record again", again)
+	}
+	conn.Write([]byte("<Ack seq=\"1\"/>\n"))
+	deadline := time.Now().Add(time.Second)
+	for ch.Queued() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := ch.Queued(); n != 0 {
+		t.Errorf("%d records still queued", n)
+	}
+}
@@ -0,0 +1,136 @@
+package output
+
+import (
+	"agent/model"
+	"bufio"
+	"encoding/xml"
+	"time"
+)
+
+/*
+XML alarm documents for automation software that ingests XML feeds
+(Manitou, MASterMind and the like). Each document is one line ending with
+LF, line breaks in the data are escaped; the automation answers each with
+an Ack or Nak line echoing its sequence number.
+
+	<Signal seq="1"><Account>1234</Account><Event>E130</Event><Zone>003</Zone><Partition>01</Partition>...</Signal>
+	<Heartbeat seq="2"></Heartbeat>
+	<Ack seq="1"/>
+*/
+
+const xmlEnd = '\n'
+
+type xmlSignal struct {
+	XMLName      xml.Name     `xml:"Signal"`
+	Seq          int          `xml:"seq,attr"`
+	Account      string       `xml:"Account"`
+	Event        string       `xml:"Event"`
+	Zone         string       `xml:"Zone"`
+	Partition    string       `xml:"Partition"`
+	ZoneName     string       `xml:"ZoneName,omitempty"`
+	User         string       `xml:"User,omitempty"`
+	UserName     string       `xml:"UserName,omitempty"`
+	AreaName     string       `xml:"AreaName,omitempty"`
+	Text         string       `xml:"Text,omitempty"`
+	Location     *xmlLocation `xml:"Location,omitempty"`
+	Verification string       `xml:"VerificationURL,omitempty"`
+	Site         string       `xml:"Site,omitempty"`
+	Receiver     int          `xml:"Receiver"`
+	Line         int          `xml:"Line"`
+	EventTime    string       `xml:"EventTime,omitempty"`
+	SignalTime   string       `xml:"SignalTime"`
+	ReceivedTime string       `xml:"ReceivedTime"`
+	Raw          string       `xml:"Raw"`
+}
+
+type xmlLocation struct {
+	Latitude  float64 `xml:"lat,attr"`
+	Longitude float64 `xml:"lon,attr"`
+}
+
+type xmlHeartbeat struct {
+	XMLName xml.Name `xml:"Heartbeat"`
+	Seq     int      `xml:"seq,attr"`
+}
+
+type xmlReply struct {
+	XMLName xml.Name
+	Seq     int `xml:"seq,attr"`
+}
+
+type xmlFeed struct {
+	config Config
+}
+
+func newXml(config Config) format {
+	return xmlFeed{config: config}
+}
+
+func (f xmlFeed) record(signal interface{}, seq int) ([]byte, bool) {
+	alarm, isAlarm := signal.(model.AlarmSignal)
+	if !isAlarm || alarm.EventCode == "" {
+		return nil, false
+	}
+	doc := xmlSignal{
+		Seq:          seq,
+		Account:      alarm.SideNo,
+		Event:        alarm.EventCode,
+		Zone:         alarm.Zone,
+		Partition:    alarm.PartNo,
+		ZoneName:     alarm.ZoneName,
+		User:         alarm.UserNo,
+		UserName:     alarm.UserName,
+		AreaName:     alarm.AreaName,
+		Text:         alarm.Text,
+		Verification: alarm.VerificationURL,
+		Site:         alarm.SiteName,
+		Receiver:     f.config.Receiver,
+		Line:         line(f.config, alarm.ReceiverId),
+		ReceivedTime: time.Now().Format(time.RFC3339),
+		Raw:          alarm.RawSignal,
+	}
+	if alarm.Location != nil {
+		doc.Location = &xmlLocation{Latitude: alarm.Location.Latitude, Longitude: alarm.Location.Longitude}
+	}
+	if alarm.EventTime != nil {
+		doc.EventTime = alarm.EventTime.Format(time.RFC3339)
+	}
+	if !alarm.SignalDateTime.IsZero() {
+		doc.SignalTime = alarm.SignalDateTime.Format(time.RFC3339)
+	}
+	return xmlLine(doc), true
+}
+
+func (f xmlFeed) heartbeat(seq int) []byte {
+	return xmlLine(xmlHeartbeat{Seq: seq})
+}
+
+func xmlLine(doc interface{}) []byte {
+	data, err := xml.Marshal(doc)
+	if err != nil {
+		// Only strings and ints, it cannot fail
+		panic(err)
+	}
+	return append(data, xmlEnd)
+}
+
+// reply reads answer lines up to the one for seq; answers to earlier
+// documents and lines that are not Ack or Nak are skipped.
+func (f xmlFeed) reply(r *bufio.Reader, seq int) (bool, error) {
+	for {
+		text, err := r.ReadString(xmlEnd)
+		if err != nil {
+			return false, err
+		}
+		var answer xmlReply
+		if xml.Unmarshal([]byte(text), &answer) != nil || answer.Seq != seq {
+			continue
+		}
+		switch answer.XMLName.Local {
+		case "Ack":
+			return true, nil
+		case "Nak":
+			return false, nil
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"agent/protocol"
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// controlNames are the <NAME> escapes accepted in frames, as receivers and
+// terminal programs usually print control bytes.
+var controlNames = map[string]byte{
+	"NUL": 0x00, "STX": 0x02, "ETX": 0x03, "EOT": 0x04, "ACK": 0x06,
+	"LF": 0x0A, "CR": 0x0D, "DC4": 0x14, "NAK": 0x15, "ETB": 0x17,
+}
+
+// parseResult is what the parse command prints for every frame.
+type parseResult struct {
+	Frame   string        `json:"frame"`
+	Rules   []string      `json:"rules"` // Sub-regexes tried, "+" matched, "-" did not
+	Signals []interface{} `json:"signals"`
+	Ack     string        `json:"ack"`
+	AckHex  string        `json:"ackHex"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// runParse decodes raw frames offline, without Pub/Sub, through the same
+// parseFrame the receiver uses, and prints signals, ACK and matched rules.
+// Frames come from the arguments, -file or stdin, one per line, and may use
+// Go escapes (\x14, \024, \r) or control names (<DC4>, <CR>).
+//
+//	agent parse -type T [-profile P] | -service NAME [-file F] [FRAME...]
+func runParse(args []string) error {
+	flags := flag.NewFlagSet("parse", flag.ContinueOnError)
+	configPath := flags.String("config", "conf.yaml", "configuration file, needed with -service")
+	serviceType := flags.String("type", "", "parser to use, e.g. SURGUARD")
+	profile := flags.String("profile", "", "DC-09 profile, e.g. prosec")
+	serviceName := flags.String("service", "", "take type, id, delimiter and key from this configured service")
+	file := flags.String("file", "", "read frames from this file instead of stdin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var service ServiceConfig
+	if *serviceName != "" {
+		if err := loadConfig(*configPath); err != nil {
+			return err
+		}
+		var exists bool
+		if service, exists = findService(*serviceName); !exists {
+			return fmt.Errorf("parse: no service named %s in %s", *serviceName, *configPath)
+		}
+	}
+	if *serviceType != "" {
+		service.Type = *serviceType
+	}
+	if *profile != "" {
+		service.Profile = *profile
+	}
+	if service.Type == "" {
+		return fmt.Errorf("parse: -type or -service is required")
+	}
+
+	frames := flags.Args()
+	if len(frames) == 0 {
+		var input io.Reader = os.Stdin
+		if *file != "" {
+			f, err := os.Open(*file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			input = f
+		}
+		scanner := bufio.NewScanner(input)
+		for scanner.Scan() {
+			if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+				frames = append(frames, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	// Parser diagnostics go to stderr so stdout stays valid JSON
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() { os.Stdout = stdout }()
+
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	for _, text := range frames {
+		frame, err := unescapeFrame(text)
+		if err != nil {
+			return fmt.Errorf("parse: %q: %w", text, err)
+		}
+		// A pasted frame may still carry its delimiter
+		if service.EndChar != 0 && len(frame) > 0 && frame[len(frame)-1] == service.EndChar {
+			frame = frame[:len(frame)-1]
+		}
+		if err := encoder.Encode(decodeFrame(frame, service)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeFrame(frame []byte, service ServiceConfig) parseResult {
+	result := parseResult{Frame: string(frame), Rules: []string{}, Signals: []interface{}{}}
+
+	protocol.Trace = func(parser, rule string, matched bool) {
+		mark := "-"
+		if matched {
+			mark = "+"
+		}
+		result.Rules = append(result.Rules, mark+parser+"/"+rule)
+	}
+	defer func() { protocol.Trace = nil }()
+
+	signals, ack, err := parseFrame(frame, service)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if signals != nil {
+		result.Signals = signals
+	}
+	result.Ack = ack
+	result.AckHex = hex.EncodeToString([]byte(ack))
+	return result
+}
+
+// unescapeFrame turns the printable form of a frame back into its bytes.
+// Unknown escapes and names, an unterminated <... and a trailing backslash
+// are kept as they are.
+func unescapeFrame(text string) ([]byte, error) {
+	var frame []byte
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '<':
+			end := strings.IndexByte(text[i:], '>')
+			if end > 0 {
+				if b, exists := controlNames[text[i+1:i+end]]; exists {
+					frame = append(frame, b)
+					i += end
+					continue
+				}
+			}
+			frame = append(frame, c)
+		case c == '\\' && i+1 < len(text):
+			i++
+			switch text[i] {
+			case 'r':
+				frame = append(frame, '\r')
+			case 'n':
+				frame = append(frame, '\n')
+			case 't':
+				frame = append(frame, '\t')
+			case '\\':
+				frame = append(frame, '\\')
+			case 'x':
+				if i+2 >= len(text) {
+					return nil, fmt.Errorf("short \\x escape")
+				}
+				b, err := strconv.ParseUint(text[i+1:i+3], 16, 8)
+				if err != nil {
+					return nil, fmt.Errorf("bad \\x escape: %w", err)
+				}
+				frame = append(frame, byte(b))
+				i += 2
+			case '0', '1', '2', '3':
+				if i+2 >= len(text) {
+					return nil, fmt.Errorf("short octal escape")
+				}
+				b, err := strconv.ParseUint(text[i:i+3], 8, 8)
+				if err != nil {
+					return nil, fmt.Errorf("bad octal escape: %w", err)
+				}
+				frame = append(frame, byte(b))
+				i += 2
+			default:
+				frame = append(frame, '\\', text[i])
+			}
+		default:
+			frame = append(frame, c)
+		}
+	}
+	return frame, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUnescapeFrame(t *testing.T) {
+	for _, test := range []struct {
+		text  string
+		frame string
+		fails bool
+	}{
+		{text: "1011           @    ", frame: "1011           @    "},
+		{text: `\x14`, frame: "\x14"},
+		{text: `\x0a\x0D`, frame: "\n\r"},
+		{text: `\x1`, fails: true},
+		{text: `\x`, fails: true},
+		{text: `\xZZ`, fails: true},
+		{text: `\024`, frame: "\x14"},
+		{text: `\377`, frame: "\xff"},
+		{text: `\02`, fails: true},
+		{text: `\029`, fails: true},
+		{text: `\r\n\t\\`, frame: "\r\n\t\\"},
+		{text: `\q`, frame: `\q`},
+		{text: `end\`, frame: `end\`},
+		{text: `\\`, frame: `\`},
+		{text: "<DC4>", frame: "\x14"},
+		{text: "<STX>1234<ETX><CR><LF>", frame: "\x021234\x03\r\n"},
+		{text: "<NUL><EOT><ACK><NAK><ETB>", frame: "\x00\x04\x06\x15\x17"},
+		{text: "<dc4>", frame: "<dc4>"},
+		{text: "<FOO>", frame: "<FOO>"},
+		{text: "<>", frame: "<>"},
+		{text: "<DC4", frame: "<DC4"},
+		{text: "a<b<DC4>", frame: "a<b\x14"},
+		{text: `<DC4>\x14\024`, frame: "\x14\x14\x14"},
+	} {
+		frame, err := unescapeFrame(test.text)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%q: got %q, want an error", test.text, frame)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.text, err)
+		} else if !bytes.Equal(frame, []byte(test.frame)) {
+			t.Errorf("%q: got %q, want %q", test.text, frame, test.frame)
+		}
+	}
+}
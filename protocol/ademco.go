@@ -3,57 +3,132 @@ package protocol
 import (
 	"agent/model"
 	"fmt"
-	"log"
-	"regexp"
-	"time"
 )
 
-var subAdemcoRegexes = map[string]*model.SubRegex{}
+var ademcoRegexes = RegexSet{}
 
 /*
-49B852128034294
-59B8518340101004
+Ademco 685 computer output. Every record starts with its type digit, then
+the receiver and line digits and a space; older lines we get without the
+receiver and line still parse.
+
+	Contact ID   5RL AAAA18QEEEGGCCC[S]   59B8518340101004, 512 123418113001003
+	4+2, 3+1     1RL AAAA EZ              112 1234 31
+	High speed   2RL AAAA CCCCCCCC S      212 1234 15555555 0
+	Phone        4RL AAAATTTTTTTTTT       49B852128034294
+	Status       6RL SS                   612 00
 */
 func init() {
-	addAdemcoRegex("ADM-CID", `^5(?<CustomerNumber>.*)(?<ContactCode>\d{2})(?<EventType>\d{1})(?<Event>\d{3})(?<Partition>\d{2})(?<Zone>\d{3}).*$`, true)
-	addAdemcoRegex("TEL", `^4(?<CustomerNumber>.*)(?<TelNumber>\d{10})$`, true)
+	const header = `(?:(?<Receiver>\d)(?<Line>\d)\s+)?`
+	// Raw Contact ID with its checksum digit first, 5RL AAAA18QEEEGGCCCS
+	ademcoRegexes.add("ADM-CID", `^5`+header+`(?<Cid>(?<CustomerNumber>[0-9A-Fa-f]{4})(?<ContactCode>18|98)(?<EventType>[136])(?<Event>[0-9A-Fa-f]{3})(?<Partition>[0-9A-Fa-f]{2})(?<Zone>[0-9A-Fa-f]{3})[0-9A-Fa-f])$`, true)
+	ademcoRegexes.add("ADM-CID", `^5`+header+`(?<CustomerNumber>[0-9A-Fa-f]{4})\s?(?<ContactCode>18|98)\s?(?<EventType>[136])\s?(?<Event>[0-9A-Fa-f]{3})\s?(?<Partition>[0-9A-Fa-f]{2})\s?(?<Zone>[0-9A-Fa-f]{3})\s*$`, true)
+	ademcoRegexes.add("FOUR-TWO", `^1(?:(?<Receiver>\d)(?<Line>\d))?\s+(?<CustomerNumber>[0-9A-Fa-f]{3,4})\s+(?<Event>[0-9A-Fa-f])(?<Zone>[0-9A-Fa-f])?\s*$`, true)
+	ademcoRegexes.add("HIGH-SPEED", `^2(?:(?<Receiver>\d)(?<Line>\d))?\s+(?<CustomerNumber>[0-9A-Fa-f]{4})\s+(?<Channels>[1-6]{8})\s*(?<Status>[0-9A-Fa-f])\s*$`, true)
+	ademcoRegexes.add("TEL", `^4`+header+`(?<CustomerNumber>[0-9A-Fa-f]{3,6}?)\s?(?<TelNumber>\d{10})\s*$`, true)
+	ademcoRegexes.add("STATUS", `^6(?<Receiver>\d)(?<Line>\d)\s+(?<Status>\d{2})\s*$`, true)
+	registerParser("ADEMCO", ademcoRegexes, parseAdemco)
 }
 
-func addAdemcoRegex(name, regexText string, isActive bool) {
-	compiledRegex, err := regexp.Compile(regexText)
-	if err != nil {
-		log.Fatalf("Regex derlenirken hata oluştu: %v", err)
-	}
-	subAdemcoRegexes[name] = &model.SubRegex{
-		Name:          name,
-		RegexText:     regexText,
-		IsActive:      isActive,
-		CompiledRegex: compiledRegex,
-	}
+// ademcoStatus maps the 685 receiver status codes to SIA codes; 00 is the
+// receiver heartbeat.
+var ademcoStatus = map[string]struct{ code, text string }{
+	"01": {"LT", "Line fault"},
+	"02": {"LR", "Line restore"},
+	"03": {"AT", "Receiver AC fail"},
+	"04": {"AR", "Receiver AC restore"},
+	"05": {"YT", "Receiver battery low"},
+	"06": {"YR", "Receiver battery restore"},
+	"07": {"VT", "Printer fault"},
+	"08": {"VR", "Printer restore"},
 }
+
+// ademcoHighSpeed maps the high speed channel digits to Contact ID events;
+// 5 (normal) and 6 (already reported) carry no event. Openings and closings
+// give the user in the channel position.
+var ademcoHighSpeed = map[byte]string{
+	'1': "E130",
+	'2': "E401",
+	'3': "R130",
+	'4': "R401",
+}
+
+// ParseAdemco parses a frame with the built-in regexes.
 func ParseAdemco(event, receiverId string) (signal []interface{}, ack string, err error) {
+	return parseAdemco(ademcoRegexes, event, receiverId)
+}
+
+func parseAdemco(regexes RegexSet, event, receiverId string) (signal []interface{}, ack string, err error) {
 	eventData := map[string]string{}
 	//fmt.Println("BAKMA BAKALIM=", event)
 
 	fmt.Println("-----------------------------------------------------------------------")
 
-	if event[0] == '5' {
-		eventData = applyAdemcoRegex(event, "ADM-CID")
+	if event == "" {
+		return nil, "", nil
+	}
+	switch event[0] {
+	case '5':
+		eventData = regexes.apply("ADEMCO", event, "ADM-CID")
+		if eventData == nil {
+			return nil, "", nil
+		}
+		signal = append(signal, cidAlarm(model.AlarmSignal{
+			Type:             "event",
+			SideNo:           eventData["CustomerNumber"],
+			ReceiverId:       receiverId,
+			ReceiverNo:       eventData["Receiver"],
+			LineNo:           eventData["Line"],
+			MonitoringCenter: 1,
+			SignalDateTime:   now(),
+			RawSignal:        event,
+		}, eventData))
+	case '1':
+		// 4+2 and 3+1 codes are programmed per panel, they are passed on as sent
+		eventData = regexes.apply("ADEMCO", event, "FOUR-TWO")
+		if eventData == nil {
+			return nil, "", nil
+		}
 		signal = append(signal, model.AlarmSignal{
 			Type:             "event",
 			SideNo:           eventData["CustomerNumber"],
 			ReceiverId:       receiverId,
 			ReceiverNo:       eventData["Receiver"],
 			LineNo:           eventData["Line"],
-			PartNo:           eventData["Partition"],
 			MonitoringCenter: 1,
-			SignalDateTime:   time.Now(),
+			SignalDateTime:   now(),
 			RawSignal:        event,
-			EventCode:        eventData["EventType"] + eventData["Event"],
+			EventCode:        eventData["Event"] + eventData["Zone"],
 			Zone:             eventData["Zone"],
 		})
-	} else if event[0] == '4' {
-		eventData = applyAdemcoRegex(event, "TEL")
+	case '2':
+		eventData = regexes.apply("ADEMCO", event, "HIGH-SPEED")
+		if eventData == nil {
+			return nil, "", nil
+		}
+		channels := eventData["Channels"]
+		for i := 0; i < len(channels); i++ {
+			code, exists := ademcoHighSpeed[channels[i]]
+			if !exists {
+				continue
+			}
+			zone := fmt.Sprintf("%03d", i+1)
+			signal = append(signal, model.AlarmSignal{
+				Type:             "event",
+				SideNo:           eventData["CustomerNumber"],
+				ReceiverId:       receiverId,
+				ReceiverNo:       eventData["Receiver"],
+				LineNo:           eventData["Line"],
+				MonitoringCenter: 1,
+				SignalDateTime:   now(),
+				RawSignal:        event,
+				EventCode:        code,
+				Zone:             zone,
+				UserNo:           userNumber(code, zone),
+			})
+		}
+	case '4':
+		eventData = regexes.apply("ADEMCO", event, "TEL")
 		if eventData == nil {
 			return nil, "", nil
 		}
@@ -65,38 +140,38 @@ func ParseAdemco(event, receiverId string) (signal []interface{}, ack string, er
 			LineNo:           eventData["Line"],
 			PhoneNo:          eventData["TelNumber"],
 			MonitoringCenter: 1,
+			RawSignal:        event,
+		})
+	case '6':
+		eventData = regexes.apply("ADEMCO", event, "STATUS")
+		if eventData == nil {
+			return nil, "", nil
+		}
+		if eventData["Status"] == "00" {
+			signal = append(signal, model.PingSignal{
+				Type:             "ping",
+				ReceiverId:       receiverId,
+				MonitoringCenter: 1,
+				RawSignal:        event,
+			})
+			break
+		}
+		status, exists := ademcoStatus[eventData["Status"]]
+		if !exists {
+			status.code, status.text = "YX", "Receiver status "+eventData["Status"]
+		}
+		signal = append(signal, model.AlarmSignal{
+			Type:             "receiver",
+			ReceiverId:       receiverId,
+			ReceiverNo:       eventData["Receiver"],
+			LineNo:           eventData["Line"],
+			MonitoringCenter: 1,
+			SignalDateTime:   now(),
+			RawSignal:        event,
+			EventCode:        status.code,
+			Text:             status.text,
 		})
 	}
 
 	return signal, string([]byte{0x06}), nil
 }
-
-func applyAdemcoRegex(eventStr, regexName string) map[string]string {
-	regex, exists := subAdemcoRegexes[regexName]
-	if !exists {
-		fmt.Printf("No regex found for %s, %s\n", eventStr, regexName)
-		return nil
-	}
-
-	match := regex.CompiledRegex.FindStringSubmatch(eventStr)
-	if match == nil {
-		fmt.Println("No match found", "GELEN=", eventStr, "REGEX", regex)
-		return nil
-	}
-
-	result := make(map[string]string)
-	for i, name := range regex.CompiledRegex.SubexpNames() {
-		if i != 0 && name != "" { // İlk eleman tam eşleşmeyi içerir ve isimsizdir
-			if name == "EventType" {
-				if match[i] == "1" {
-					match[i] = "E"
-				} else if match[i] == "3" {
-					match[i] = "R"
-				}
-			}
-			result[name] = match[i]
-		}
-	} // BURAYI SİLMEK İSTİYORUM YSF
-
-	return result
-}
@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"agent/model"
+	"fmt"
+	"strconv"
+)
+
+// Contact ID checksum enforcement, per service.
+const (
+	CidChecksumOff  = "off"  // Raw Contact ID strings are not checked
+	CidChecksumFlag = "flag" // Bad checksums are ACKed and published with BadChecksum set, the default
+	CidChecksumNak  = "nak"  // Bad checksums are answered with NAK (0x15) and not published
+)
+
+// cidAlarm fills the Contact ID fields of base from the groups of a CID rule:
+// the qualifier and event, partition, zone or user, and the checksum when the
+// rule captured the raw message.
+func cidAlarm(base model.AlarmSignal, data map[string]string) model.AlarmSignal {
+	alarm := base
+	alarm.EventCode = data["EventType"] + data["Event"]
+	alarm.PartNo = data["Partition"]
+	alarm.Zone = data["Zone"]
+	alarm.UserNo = userNumber(alarm.EventCode, alarm.Zone)
+	alarm.BadChecksum = checkCid(data)
+	return alarm
+}
+
+// cidNak asks the sender to repeat a corrupted message.
+var cidNak = string([]byte{0x15})
+
+// cidChecksumValid reports whether a raw 16 digit Contact ID message,
+// "AAAA18QEEEGGCCCS", passes the mod-15 check: its digit values, with 0
+// counting as 10, add up to a multiple of 15.
+func cidChecksumValid(raw string) bool {
+	if len(raw) != 16 {
+		return false
+	}
+	sum := 0
+	for i := 0; i < len(raw); i++ {
+		v, err := strconv.ParseUint(raw[i:i+1], 16, 8)
+		if err != nil {
+			return false
+		}
+		if v == 0 {
+			v = 10
+		}
+		sum += int(v)
+	}
+	return sum%15 == 0
+}
+
+// checkCid validates the raw Contact ID a rule captured in its Cid group, if
+// any. Layouts without a checksum digit have no Cid group and always pass.
+func checkCid(data map[string]string) (badChecksum bool) {
+	raw, exists := data["Cid"]
+	if !exists || raw == "" {
+		return false
+	}
+	if !cidChecksumValid(raw) {
+		fmt.Printf("Contact ID checksum error: %s\n", raw)
+		return true
+	}
+	return false
+}
+
+// enforceCidChecksum applies the service's checksum enforcement to the
+// signals of a frame.
+func enforceCidChecksum(mode string, signals []interface{}, ack string) ([]interface{}, string) {
+	for i, s := range signals {
+		alarm, isAlarm := s.(model.AlarmSignal)
+		if !isAlarm || !alarm.BadChecksum {
+			continue
+		}
+		switch mode {
+		case CidChecksumNak:
+			return nil, cidNak
+		case CidChecksumOff:
+			alarm.BadChecksum = false
+			signals[i] = alarm
+		}
+	}
+	return signals, ack
+}
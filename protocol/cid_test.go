@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"agent/model"
+	"testing"
+)
+
+func TestCidChecksum(t *testing.T) {
+	fixClock(t)
+	good, bad := "51234181130010037", "51234181130010038"
+
+	tests := []struct {
+		mode        string
+		frame       string
+		wantAck     string
+		wantSignals int
+		wantFlag    bool
+	}{
+		{mode: "", frame: good, wantAck: "\x06", wantSignals: 1},
+		{mode: CidChecksumFlag, frame: bad, wantAck: "\x06", wantSignals: 1, wantFlag: true},
+		{mode: CidChecksumOff, frame: bad, wantAck: "\x06", wantSignals: 1},
+		{mode: CidChecksumNak, frame: bad, wantAck: "\x15"},
+		{mode: CidChecksumNak, frame: good, wantAck: "\x06", wantSignals: 1},
+		// No checksum digit, nothing to check
+		{mode: CidChecksumNak, frame: "5123418113001003", wantAck: "\x06", wantSignals: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode+"/"+tt.frame, func(t *testing.T) {
+			parser, err := NewParser("ADEMCO", Options{CidChecksum: tt.mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			signals, ack, err := parser.Parse(tt.frame, "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ack != tt.wantAck {
+				t.Errorf("ack = %q, want %q", ack, tt.wantAck)
+			}
+			if len(signals) != tt.wantSignals {
+				t.Fatalf("%d signals, want %d", len(signals), tt.wantSignals)
+			}
+			if len(signals) > 0 && signals[0].(model.AlarmSignal).BadChecksum != tt.wantFlag {
+				t.Errorf("BadChecksum = %v, want %v", !tt.wantFlag, tt.wantFlag)
+			}
+		})
+	}
+
+	if _, err := NewParser("ADEMCO", Options{CidChecksum: "strict"}); err == nil {
+		t.Error("unknown cidChecksum mode accepted")
+	}
+}
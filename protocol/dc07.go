@@ -0,0 +1,122 @@
+package protocol
+
+import (
+	"agent/model"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+var dc07Regexes = RegexSet{}
+
+/*
+SIA DC-07 receiver to automation interface. Messages are DC-09 bodies
+without CRC, length and time stamp, between LF and CR; the automation
+answers each with an ACK or NAK echoing its sequence number. NULL messages
+supervise the link.
+
+	<LF>"ADM-CID"0001R1L2#1234[#1234|1130 01 003]<CR>
+	<LF>"SIA-DCS"0002R1L2#1234[#1234|Nri1/BA004]<CR>
+	<LF>"NULL"0003R1L0#0[]<CR>
+	<LF>"ACK"0003<CR>
+*/
+func init() {
+	dc07Regexes.add("mainRegex", `^\n?"(?<MessageType>SIA-DCS|ADM-CID|NULL)"(?<Sequence>\d{4})R(?<Receiver>[0-9A-Fa-f]{1,6})L(?<Line>[0-9A-Fa-f]{1,6})#(?<CustomerNumber>[0-9A-Fa-f]{1,16})\[(?<Data>[^\r\n]*)\]\r?$`, true)
+	dc07Regexes.add("ADM-CID", `^#?(?<CustomerNumber>[0-9A-Fa-f]*)\|(?<EventType>[136])(?<Event>[0-9A-Fa-f]{3})\s?(?<Partition>[0-9A-Fa-f]{2})\s?(?<Zone>[0-9A-Fa-f]{3})$`, true)
+	dc07Regexes.add("SIA-DCS", `^#?(?<CustomerNumber>[0-9A-Fa-f]*)\|N(?:ri(?<Partition>\d+)\/)?(?<Events>[^\]]+)$`, true)
+	registerParser("DC07", dc07Regexes, parseDc07)
+	dc07Message = dc07Regexes["mainRegex"][0].CompiledRegex
+}
+
+var dc07Reply = regexp.MustCompile(`"(ACK|NAK)"(\d{4})`)
+
+// Dc07Message frames one DC-07 message, the sequence number running 0001
+// to 9999.
+func Dc07Message(messageType string, seq, receiver, line int, account, data string) string {
+	return fmt.Sprintf("\n\"%s\"%04dR%dL%d#%s[%s]\r", messageType, (seq-1)%9999+1, receiver, line, account, data)
+}
+
+// Dc07Ack is the answer to the message with sequence number seq.
+func Dc07Ack(seq string) string {
+	return "\n\"ACK\"" + seq + "\r"
+}
+
+// ParseDc07Reply reads an ACK or NAK; ok is false when reply is neither.
+func ParseDc07Reply(reply string) (ack bool, seq int, ok bool) {
+	match := dc07Reply.FindStringSubmatch(reply)
+	if match == nil {
+		return false, 0, false
+	}
+	seq, _ = strconv.Atoi(match[2])
+	return match[1] == "ACK", seq, true
+}
+
+// dc07Message is the built-in frame regex, used to find sequence numbers.
+var dc07Message *regexp.Regexp
+
+// Dc07Sequence returns the receiver and line of a DC-07 alarm message and its
+// sequence number, ok is false for NULL messages and other frames. A message
+// repeating the last sequence number delivered from its line is a
+// retransmission: ACKed again, not published twice. Parsing keeps no such
+// state, the connection does once the message is delivered.
+func Dc07Sequence(event string) (line, seq string, ok bool) {
+	match := dc07Message.FindStringSubmatch(event)
+	if match == nil || match[dc07Message.SubexpIndex("MessageType")] == "NULL" {
+		return "", "", false
+	}
+	line = match[dc07Message.SubexpIndex("Receiver")] + "/" + match[dc07Message.SubexpIndex("Line")]
+	return line, match[dc07Message.SubexpIndex("Sequence")], true
+}
+
+// ParseDc07 parses a frame with the built-in regexes.
+func ParseDc07(event, receiverId string) (signal []interface{}, ack string, err error) {
+	return parseDc07(dc07Regexes, event, receiverId)
+}
+
+func parseDc07(regexes RegexSet, event, receiverId string) (signal []interface{}, ack string, err error) {
+	fmt.Println("-----------------------------------------------------------------------")
+
+	mainData := regexes.apply("DC07", event, "mainRegex")
+	if mainData == nil {
+		return nil, "", nil
+	}
+	// Messages we cannot decode are ACKed too and published as unparsed
+	ack = Dc07Ack(mainData["Sequence"])
+
+	base := model.AlarmSignal{
+		Type:             "event",
+		SideNo:           mainData["CustomerNumber"],
+		ReceiverId:       receiverId,
+		ReceiverNo:       mainData["Receiver"],
+		LineNo:           mainData["Line"],
+		MonitoringCenter: 1,
+		SignalDateTime:   now(),
+		RawSignal:        event,
+	}
+	switch mainData["MessageType"] {
+	case "ADM-CID":
+		eventData := regexes.apply("DC07", mainData["Data"], "ADM-CID")
+		if eventData == nil {
+			return append(signal, unparsedAlarm(base)), ack, nil
+		}
+		signal = append(signal, cidAlarm(base, eventData))
+	case "SIA-DCS":
+		eventData := regexes.apply("DC07", mainData["Data"], "SIA-DCS")
+		if eventData == nil {
+			return append(signal, unparsedAlarm(base)), ack, nil
+		}
+		base.PartNo = eventData["Partition"]
+		if signal = siaAlarms(base, eventData["Events"]); signal == nil {
+			signal = append(signal, unparsedAlarm(base))
+		}
+	case "NULL":
+		signal = append(signal, model.PingSignal{
+			Type:             "ping",
+			SideNo:           mainData["CustomerNumber"],
+			ReceiverId:       receiverId,
+			MonitoringCenter: 1,
+			RawSignal:        event,
+		})
+	}
+	return signal, ack, nil
+}
@@ -0,0 +1,34 @@
+package protocol
+
+import "testing"
+
+func TestDc07Sequence(t *testing.T) {
+	for _, tt := range []struct {
+		frame string
+		line  string
+		seq   string
+		ok    bool
+	}{
+		{"\n\"ADM-CID\"0042R1L2#1234[#1234|1130 01 003]\r", "1/2", "0042", true},
+		{"\"SIA-DCS\"0043R1AL0#1234[#1234|Nri1/BA004]", "1A/0", "0043", true},
+		{"\n\"NULL\"0044R1L0#0[]\r", "", "", false},
+		{"\n\"ACK\"0042\r", "", "", false},
+		{"1130 01 003", "", "", false},
+	} {
+		line, seq, ok := Dc07Sequence(tt.frame)
+		if line != tt.line || seq != tt.seq || ok != tt.ok {
+			t.Errorf("Dc07Sequence(%q) = %q, %q, %t; want %q, %q, %t", tt.frame, line, seq, ok, tt.line, tt.seq, tt.ok)
+		}
+	}
+}
+
+func TestParseDc07Stateless(t *testing.T) {
+	fixClock(t)
+	frame := "\n\"ADM-CID\"0042R1L2#1234[#1234|1130 01 003]"
+	for i := 0; i < 2; i++ {
+		signals, ack, err := ParseDc07(frame, "1")
+		if err != nil || len(signals) != 1 || ack != Dc07Ack("0042") {
+			t.Errorf("parse %d: %v, %q, %v", i, signals, ack, err)
+		}
+	}
+}
@@ -3,100 +3,271 @@ package protocol
 import (
 	"agent/model"
 	"fmt"
-	"log"
+	"math"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
 
-var subDc09Regexes = map[string]*model.SubRegex{}
+// Dc09Profile declares how one vendor's DC-09 dialect differs from the
+// standard. All profiles run through the same engine, so a new vendor is
+// added by declaring its quirks here, not by copying a parser.
+type Dc09Profile struct {
+	Name           string
+	CidPrefix      string // Text in front of the Contact ID event, Teknim sends the "18" format code
+	ZoneNameBlock  bool   // The "[I...]" block names the zone rather than being alarm text, e.g. Fonri NOVA's "[IKeypad]"
+	SiaWithoutArea bool   // SIA data may leave out "ri<area>/", e.g. PROSEC's "NRP"
+	ByteAck        bool   // Answered with a bare 0x06 instead of a DC-09 ACK message
+}
 
-/*
-OPAX
+// dc09ProfileNames are the profiles by name, in the order they are listed.
+var dc09ProfileNames []string
 
-Å[002A"NULL"0000R8L0#41213[]_21:00:10,02-20-2024
-Á~003E"ADM-CID"0379R0L0#10064[10064|1602 00 000]_00:00:43,02-21-2024
+var dc09Profiles = map[string]Dc09Profile{}
 
-PROSEC
-B0970029"NULL"0000L000#0809[]_21:00:01,02-20-2024
-F68B003B"ADM-CID"0028L0#9757[#9757|1602 00 000]_20:59:45,02-20-2024
-B4330036"SIA-DCS"0442L000#36214[36214|NRP]_00:00:00,02-21-2024
-3F60003C"SIA-DCS"0001L0#51449[#51449|Nri0000/LR]_21:26:19,12-20-2023
-7B620035"SIA-DCS"0005L000#3044[3044|NOP1]_00:03:31,12-21-2023
-85340035"SIA-DCS"0004L000#3044[3044|NBC1]_00:03:31,12-21-2023
+// dc09Aliases are the service types that are a DC-09 profile under another name.
+var dc09Aliases = map[string]string{
+	"DC09":   "generic",
+	"TEKNIM": "teknim",
+	"FONRI":  "fonri-nova",
+}
 
-HIKVISION
-99820040"ADM-CID"1937R15L1#21401[#21401|1602 00 000]_20:59:59,02-20-2024
-*/
 func init() {
-	addDc09Regex("mainRegex", `(?<Length>.*)"(?<MessageType>SIA-DCS|ADM-CID|NULL)"(?<Sequence>[0-9]{4})R?(?<Receiver>[A-Fa-f0-9]{1,6})?L(?<Line>[A-Fa-f0-9]{1,6})[#]?(?<CustomerNumber>[A-Fa-f0-9]{3,16})?[\[](?<Data>.*)$`, true)
-	addDc09Regex("ADM-CID", `(?P<CustomerNumber>.*)\|(?P<EventType>[a-zA-Z1-9]{1})(?P<Event>\d{3})\s?(?P<Partition>\d{2})\s?(?P<Zone>\d{3}).*$`, true)
-	addDc09Regex("SIA-DCS", `[#(?<CustomerNumber>\d+)[F]*\|Nri(?<Partition>\d)\/(?<Events>.+?)\]`, true)
-	addDc09Regex("NULL", `[\]][_]?(?<TimeStamp>[0-9:,-_\s]*)?$`, true)
+	registerDc09Profile(Dc09Profile{Name: "generic"})
+
+	// OPAX puts a noise byte in front of the CRC, which the main regex skips.
+	//
+	//	Å[002A"NULL"0000R8L0#41213[]_21:00:10,02-20-2024
+	//	Á~003E"ADM-CID"0379R0L0#10064[10064|1602 00 000]_00:00:43,02-21-2024
+	registerDc09Profile(Dc09Profile{Name: "opax"})
+
+	//	B0970029"NULL"0000L000#0809[]_21:00:01,02-20-2024
+	//	F68B003B"ADM-CID"0028L0#9757[#9757|1602 00 000]_20:59:45,02-20-2024
+	//	B4330036"SIA-DCS"0442L000#36214[36214|NRP]_00:00:00,02-21-2024
+	//	3F60003C"SIA-DCS"0001L0#51449[#51449|Nri0000/LR]_21:26:19,12-20-2023
+	//	7B620035"SIA-DCS"0005L000#3044[3044|NOP1]_00:03:31,12-21-2023
+	registerDc09Profile(Dc09Profile{Name: "prosec", SiaWithoutArea: true})
+
+	//	99820040"ADM-CID"1937R15L1#21401[#21401|1602 00 000]_20:59:59,02-20-2024
+	registerDc09Profile(Dc09Profile{Name: "hikvision"})
+
+	//	59630027"NULL"0000L1#699F[]_23:50:57,02-20-2024
+	//	56b8003c"ADM-CID"1569L1#6827[#6827|18160201000D]_00:00:00,02-21-2024
+	//	39660039"SIA-DCS"0512L1#9764[#9764|Nri1/OP03]_00:41:51,06-13-2000
+	registerDc09Profile(Dc09Profile{Name: "teknim", CidPrefix: "18", ByteAck: true})
+
+	//	1E5A0046"ADM-CID"1709L0#63121[#63121|1401 01 001][IKeypad]_01:07:45,02-21-2024
+	registerDc09Profile(Dc09Profile{Name: "fonri-nova", ZoneNameBlock: true, ByteAck: true})
+}
+
+// registerDc09Profile builds the regexes of a profile and registers it as the
+// parser type "DC09/<name>".
+func registerDc09Profile(profile Dc09Profile) {
+	regexes := profile.regexes()
+	dc09Profiles[profile.Name] = profile
+	dc09ProfileNames = append(dc09ProfileNames, profile.Name)
+	registerParser("DC09/"+profile.Name, regexes, func(regexes RegexSet, event, receiverId string) ([]interface{}, string, error) {
+		return parseDc09(profile, regexes, event, receiverId)
+	})
+}
+
+func (p Dc09Profile) regexes() RegexSet {
+	cid := `#?(?P<CustomerNumber>[^|]*)\|` + p.CidPrefix + `(?P<EventType>[a-zA-Z1-9]{1})(?P<Event>\d{3})\s?(?P<Partition>\d{2})\s?(?P<Zone>\d{3})`
+	area := `ri(?<Partition>\d+)\/`
+	if p.SiaWithoutArea {
+		area = `(?:` + area + `)?`
+	}
+
+	regexes := RegexSet{}
+	regexes.add("mainRegex", `(?<Length>[^"\r\n]*)"(?<MessageType>SIA-DCS|ADM-CID|NULL)"(?<Sequence>[0-9]{4})R?(?<Receiver>[A-Fa-f0-9]{1,6})?L(?<Line>[A-Fa-f0-9]{1,6})[#]?(?<CustomerNumber>[A-Fa-f0-9]{3,16})?[\[](?<Data>.*)$`, true)
+	regexes.add("ADM-CID", cid+`.*$`, true)
+	regexes.add("SIA-DCS", `#?(?<CustomerNumber>[A-Fa-f0-9]*)F*\|N`+area+`(?<Events>[^\]]+)\]`, true)
+	regexes.add("NULL", `[\]][_]?(?<TimeStamp>[0-9:,\-_\s]*)?$`, true)
+	return regexes
+}
+
+// dc09Block is an extended data block like "[IKeypad]": a letter naming the
+// field and its text.
+var dc09Block = regexp.MustCompile(`\[([A-Z])([^\[\]]*)\]`)
+
+// dc09Blocks returns the extended data blocks that follow the event data of a
+// message, by their letter.
+func dc09Blocks(data string) map[string]string {
+	blocks := map[string]string{}
+	end := strings.IndexByte(data, ']')
+	if end < 0 {
+		return blocks
+	}
+	for _, m := range dc09Block.FindAllStringSubmatch(data[end+1:], -1) {
+		blocks[m[1]] = m[2]
+	}
+	return blocks
 }
 
-func addDc09Regex(name, regexText string, isActive bool) {
-	compiledRegex, err := regexp.Compile(regexText)
-	if err != nil {
-		log.Fatalf("Regex derlenirken hata oluştu: %v", err)
+// names fills the zone, user and area names and the alarm text of a signal
+// from the extended data blocks: [I] alarm text, [A] area name, [U] user name.
+// The user number comes with the event, from siaAlarms or cidAlarm.
+func (p Dc09Profile) names(signal *model.AlarmSignal, blocks map[string]string) {
+	if p.ZoneNameBlock {
+		signal.ZoneName = blocks["I"]
+	} else {
+		signal.Text = blocks["I"]
+	}
+	signal.AreaName = blocks["A"]
+	signal.UserName = blocks["U"]
+}
+
+// dc09Time is the layout of the [H] block, "15:04:05,01-02-2006" with the
+// comma read as a space: time.Parse takes ",0" after the seconds for a fraction.
+const dc09Time = "15:04:05 01-02-2006"
+
+// dc09Mac is a MAC address with or without separators.
+var dc09Mac = regexp.MustCompile(`^([0-9A-Fa-f]{2})[:-]?([0-9A-Fa-f]{2})[:-]?([0-9A-Fa-f]{2})[:-]?([0-9A-Fa-f]{2})[:-]?([0-9A-Fa-f]{2})[:-]?([0-9A-Fa-f]{2})$`)
+
+// dc09Extended fills the typed fields of the other extended data blocks:
+// [X] longitude and [Y] latitude, [H] event time, [M] MAC address,
+// [V] verification URL, [S] site name and [P] program data. Blocks that do
+// not hold what they should are left out rather than failing the alarm.
+//
+//	[XE28.97953][YN41.01512][H10:15:00,02-21-2024][M00:1B:C5:0A:12:34][Vhttps://nvr.example/clip/81]
+func dc09Extended(signal *model.AlarmSignal, blocks map[string]string) {
+	longitude, okX := dc09Coordinate(blocks["X"], 'E', 'W')
+	latitude, okY := dc09Coordinate(blocks["Y"], 'N', 'S')
+	if okX && okY && latitude >= -90 && latitude <= 90 && longitude >= -180 && longitude <= 180 {
+		signal.Location = &model.Location{Latitude: latitude, Longitude: longitude}
+	}
+	if h, exists := blocks["H"]; exists {
+		if t, err := time.Parse(dc09Time, strings.Replace(strings.TrimSpace(h), ",", " ", 1)); err == nil {
+			signal.EventTime = &t
+		}
+	}
+	if m := dc09Mac.FindStringSubmatch(strings.TrimSpace(blocks["M"])); m != nil {
+		signal.MAC = strings.ToUpper(strings.Join(m[1:], ":"))
 	}
-	subDc09Regexes[name] = &model.SubRegex{
-		Name:          name,
-		RegexText:     regexText,
-		IsActive:      isActive,
-		CompiledRegex: compiledRegex,
+	if u, err := url.Parse(strings.TrimSpace(blocks["V"])); err == nil && u.Scheme != "" && u.Host != "" {
+		signal.VerificationURL = u.String()
 	}
+	signal.SiteName = blocks["S"]
+	signal.ProgramData = blocks["P"]
 }
+
+// dc09Coordinate reads a coordinate in decimal degrees, signed or led by its
+// hemisphere letter: "E28.97953", "W0.1276" or "-0.1276".
+func dc09Coordinate(text string, positive, negative byte) (float64, bool) {
+	text = strings.TrimSpace(text)
+	sign := 1.0
+	if text != "" {
+		switch text[0] {
+		case positive:
+			text = text[1:]
+		case negative:
+			text, sign = text[1:], -1
+		}
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, false
+	}
+	return sign * value, true
+}
+
+// Dc09ProfileFor returns the DC-09 profile a service type and profile name
+// select, and false when the service type is not DC-09.
+func Dc09ProfileFor(serviceType, profile string) (Dc09Profile, bool) {
+	name, isDc09 := dc09Aliases[serviceType]
+	if !isDc09 {
+		return Dc09Profile{}, false
+	}
+	if profile != "" {
+		name = profile
+	}
+	p, exists := dc09Profiles[name]
+	return p, exists
+}
+
+// Dc09Profiles lists the names of the DC-09 profiles.
+func Dc09Profiles() []string {
+	return dc09ProfileNames
+}
+
+// ParseDc09 parses a frame with the generic profile and its built-in regexes.
 func ParseDc09(event, receiverId string) (signal []interface{}, ack string, err error) {
+	return parseDc09Builtin("generic", event, receiverId)
+}
+
+func parseDc09Builtin(profile, event, receiverId string) (signal []interface{}, ack string, err error) {
+	return parseDc09(dc09Profiles[profile], parserTypes["DC09/"+profile].regexes, event, receiverId)
+}
+
+// dc09Ack answers a message with its own CRC and length, the receiver is left
+// out when the message had none.
+func dc09Ack(mainData map[string]string) string {
+	receiver := ""
+	if mainData["Receiver"] != "" {
+		receiver = "R" + mainData["Receiver"]
+	}
+	body := "\"ACK\"" + mainData["Sequence"] + receiver + "L" + mainData["Line"] + "#" + mainData["CustomerNumber"] + "[]"
+	return "\n" + Dc09Frame(body) + "\r"
+}
+
+func parseDc09(profile Dc09Profile, regexes RegexSet, event, receiverId string) (signal []interface{}, ack string, err error) {
 	mainData := map[string]string{}
 	eventData := map[string]string{}
-	//fmt.Println("BAKMA BAKALIM=", event)
-	mainData = applyDc09Regex(event, "mainRegex")
-	//fmt.Println("BAK BAKALIM=", mainData["Data"])
+	mainData = regexes.apply("DC09", event, "mainRegex")
 
 	fmt.Println("-----------------------------------------------------------------------")
 	if mainData == nil {
 		return nil, "", nil
 	}
+	// l[003C"ADM-CID"0148R0L0#8362[8362|1602 00 000]_00:00:09,06-11-2022
+	// l[003C"ACK"0148R0L0#8362[]
+	//<LF><CRC><0LLL><"ACK"><seq><Rrcvr><Lpref><#acct>[]<CR>
+	//Y9002A"NULL"0000R8L0#41213[]_21:00:08,06-10-2022
+	//Y9002A"ACK"0000R8L0#41213[]
+	// Messages we cannot decode are ACKed too and published as unparsed, the
+	// panel could only send them again
+	if profile.ByteAck {
+		ack = string([]byte{0x06})
+	} else {
+		ack = dc09Ack(mainData)
+	}
 
-	if mainData["MessageType"] == "SIA-DCS" {
-		eventData = applyDc09Regex(mainData["Data"], "SIA-DCS")
-		events := strings.Split(eventData["Events"], "/")
-		for _, e := range events {
-			fmt.Println("events", e)
-			evt, zn := model.SiaEventOrZone(e)
-			signal = append(signal, model.AlarmSignal{
-				Type:             "event",
-				SideNo:           mainData["CustomerNumber"],
-				ReceiverId:       receiverId,
-				ReceiverNo:       mainData["Receiver"],
-				LineNo:           mainData["Line"],
-				PartNo:           eventData["Partition"],
-				MonitoringCenter: 1,
-				SignalDateTime:   time.Now(),
-				RawSignal:        event,
-				EventCode:        evt,
-				Zone:             zn,
-			})
-			//fmt.Println("Test Json", signal)
+	blocks := dc09Blocks(mainData["Data"])
+	base := model.AlarmSignal{
+		Type:             "event",
+		SideNo:           mainData["CustomerNumber"],
+		ReceiverId:       receiverId,
+		ReceiverNo:       mainData["Receiver"],
+		LineNo:           mainData["Line"],
+		MonitoringCenter: 1,
+		SignalDateTime:   now(),
+		RawSignal:        event,
+	}
+	switch mainData["MessageType"] {
+	case "SIA-DCS":
+		eventData = regexes.apply("DC09", mainData["Data"], "SIA-DCS")
+		if eventData == nil {
+			return append(signal, unparsedAlarm(base)), ack, nil
 		}
-	} else if mainData["MessageType"] == "ADM-CID" {
-		eventData = applyDc09Regex(mainData["Data"], "ADM-CID")
-		signal = append(signal, model.AlarmSignal{
-			Type:             "event",
-			SideNo:           eventData["CustomerNumber"],
-			ReceiverId:       receiverId,
-			ReceiverNo:       mainData["Receiver"],
-			LineNo:           mainData["Line"],
-			PartNo:           eventData["Partition"],
-			MonitoringCenter: 1,
-			SignalDateTime:   time.Now(),
-			RawSignal:        event,
-			EventCode:        eventData["EventType"] + eventData["Event"],
-			Zone:             eventData["Zone"],
-		})
-	} else if mainData["MessageType"] == "NULL" {
-		eventData = applyDc09Regex(mainData["Data"], "NULL")
+		base.PartNo = eventData["Partition"]
+		profile.names(&base, blocks)
+		dc09Extended(&base, blocks)
+		if signal = siaAlarms(base, eventData["Events"]); signal == nil {
+			signal = append(signal, unparsedAlarm(base))
+		}
+	case "ADM-CID":
+		eventData = regexes.apply("DC09", mainData["Data"], "ADM-CID")
+		if eventData == nil {
+			return append(signal, unparsedAlarm(base)), ack, nil
+		}
+		base.SideNo = eventData["CustomerNumber"]
+		profile.names(&base, blocks)
+		dc09Extended(&base, blocks)
+		signal = append(signal, cidAlarm(base, eventData))
+	case "NULL":
+		regexes.apply("DC09", mainData["Data"], "NULL")
 		signal = append(signal, model.PingSignal{
 			Type:             "ping",
 			SideNo:           mainData["CustomerNumber"],
@@ -105,40 +276,5 @@ func ParseDc09(event, receiverId string) (signal []interface{}, ack string, err
 			RawSignal:        event,
 		})
 	}
-	// l[003C"ADM-CID"0148R0L0#8362[8362|1602 00 000]_00:00:09,06-11-2022
-	// l[003C"ACK"0148R0L0#8362[]
-	//<LF><CRC><0LLL><"ACK"><seq><Rrcvr><Lpref><#acct>[]<CR>
-	//Y9002A"NULL"0000R8L0#41213[]_21:00:08,06-10-2022
-	//Y9002A"ACK"0000R8L0#41213[]
-	return signal, "\n" + mainData["Length"] + "\"ACK\"" + mainData["Sequence"] + "R" + mainData["Receiver"] + "L" + mainData["Line"] + "#" + mainData["CustomerNumber"] + "[]" + "\r", nil
-}
-
-func applyDc09Regex(eventStr, regexName string) map[string]string {
-	regex, exists := subDc09Regexes[regexName]
-	if !exists {
-		fmt.Printf("No regex found for %s, %s\n", eventStr, regexName)
-		return nil
-	}
-
-	match := regex.CompiledRegex.FindStringSubmatch(eventStr)
-	if match == nil {
-		fmt.Println("No match found", "GELEN=", eventStr, "REGEX", regex)
-		return nil
-	}
-
-	result := make(map[string]string)
-	for i, name := range regex.CompiledRegex.SubexpNames() {
-		if i != 0 && name != "" { // İlk eleman tam eşleşmeyi içerir ve isimsizdir
-			if name == "EventType" {
-				if match[i] == "1" {
-					match[i] = "E"
-				} else if match[i] == "3" {
-					match[i] = "R"
-				}
-			}
-			result[name] = match[i]
-		}
-	} // BURAYI SİLMEK İSTİYORUM YSF
-
-	return result
+	return signal, ack, nil
 }
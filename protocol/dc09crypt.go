@@ -0,0 +1,144 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+Encrypted DC-09 (AES-CBC, zero IV) marks the message type with '*' and replaces
+everything after '[' with the hex encoded cipher text of "<pad>|<data>":
+
+C1A2007C"*SIA-DCS"0005R0L0#1234[7B1F...9A0C
+decrypts to
+8Xq2|#1234|Nri1/BA003]_14:12:04,02-21-2024
+*/
+
+const padChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// IsEncryptedDc09 reports whether a DC-09 frame carries an encrypted message type.
+func IsEncryptedDc09(event string) bool {
+	return strings.Contains(event, `"*`)
+}
+
+func dc09Cipher(key string) (cipher.Block, error) {
+	raw, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("DC-09 key is not hex: %w", err)
+	}
+	return aes.NewCipher(raw)
+}
+
+// DecryptDc09 turns an encrypted DC-09 frame into its plain form, so the
+// regular parsers can read it.
+func DecryptDc09(event, key string) (string, error) {
+	block, err := dc09Cipher(key)
+	if err != nil {
+		return "", err
+	}
+	open := strings.Index(event, "[")
+	if open < 0 {
+		return "", fmt.Errorf("encrypted DC-09 frame has no data block")
+	}
+
+	cipherText, err := hex.DecodeString(strings.TrimRight(event[open+1:], "\r\n"))
+	if err != nil {
+		return "", fmt.Errorf("encrypted DC-09 data is not hex: %w", err)
+	}
+	if len(cipherText) == 0 || len(cipherText)%aes.BlockSize != 0 {
+		return "", fmt.Errorf("encrypted DC-09 data is not a multiple of the block size")
+	}
+	plain := make([]byte, len(cipherText))
+	cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(plain, cipherText)
+
+	pad := strings.Index(string(plain), "|")
+	if pad < 0 {
+		return "", fmt.Errorf("decrypted DC-09 data has no pad separator, wrong key?")
+	}
+	head := strings.Replace(event[:open], `"*`, `"`, 1)
+	return head + "[" + string(plain[pad+1:]), nil
+}
+
+// encryptDc09Data returns the hex cipher text of "<pad>|<data>", padded to a
+// whole number of blocks.
+func encryptDc09Data(data, key string) (string, error) {
+	block, err := dc09Cipher(key)
+	if err != nil {
+		return "", err
+	}
+	padLen := aes.BlockSize - (len(data)+1)%aes.BlockSize
+	pad := make([]byte, padLen)
+	if _, err := rand.Read(pad); err != nil {
+		return "", err
+	}
+	for i := range pad {
+		pad[i] = padChars[int(pad[i])%len(padChars)]
+	}
+
+	plain := []byte(string(pad) + "|" + data)
+	cipherText := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(cipherText, plain)
+	return strings.ToUpper(hex.EncodeToString(cipherText)), nil
+}
+
+// EncryptDc09 is the inverse of DecryptDc09, used to build encrypted frames.
+func EncryptDc09(event, key string) (string, error) {
+	open := strings.Index(event, "[")
+	if open < 0 {
+		return "", fmt.Errorf("DC-09 frame has no data block")
+	}
+	data, err := encryptDc09Data(event[open+1:], key)
+	if err != nil {
+		return "", err
+	}
+	head := strings.Replace(event[:open], `"`, `"*`, 1)
+	return head + "[" + data, nil
+}
+
+// EncryptDc09Ack turns the plain ACK of a DC-09 parser into the encrypted ACK
+// an encrypting panel expects. The encrypted block carries the receiver time.
+// ACKs that are not DC-09 messages, like a bare 0x06, are returned unchanged.
+func EncryptDc09Ack(ack, key string) (string, error) {
+	if !strings.Contains(ack, `"ACK"`) {
+		return ack, nil
+	}
+	start, open := strings.Index(ack, `"ACK"`), strings.Index(ack, "[")
+	data, err := encryptDc09Data("]"+Dc09Timestamp(now()), key)
+	if err != nil {
+		return "", err
+	}
+	body := `"*ACK"` + ack[start+len(`"ACK"`):open] + "[" + data
+	return "\n" + Dc09Frame(body) + "\r", nil
+}
+
+// Dc09Timestamp formats t as the DC-09 "_HH:MM:SS,MM-DD-YYYY" suffix in UTC.
+func Dc09Timestamp(t time.Time) string {
+	return t.UTC().Format("_15:04:05,01-02-2006")
+}
+
+// Dc09Crc is the CRC-16/ARC DC-09 puts in front of every message.
+func Dc09Crc(body string) uint16 {
+	var crc uint16
+	for i := 0; i < len(body); i++ {
+		crc ^= uint16(body[i])
+		for bit := 0; bit < 8; bit++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// Dc09Frame prefixes a message body, starting at the opening quote of the
+// message type, with its CRC and length.
+func Dc09Frame(body string) string {
+	return fmt.Sprintf("%04X0%03X%s", Dc09Crc(body), len(body), body)
+}
@@ -0,0 +1,145 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+// addGoldenSeeds seeds a fuzz target with every golden frame, of all parsers,
+// so each parser also sees the other vendors' framing.
+func addGoldenSeeds(f *testing.F) {
+	for name := range goldenParsers {
+		for _, c := range loadGolden(f, name) {
+			f.Add(c.Frame)
+		}
+	}
+	f.Add("")
+	f.Add("5")
+	f.Add(`"SIA-DCS"0000L0[`)
+	f.Add(`"ADM-CID"0000L0#1[|`)
+}
+
+// checkParse runs one fuzz input and asserts the invariants every parser keeps:
+// no panic, a bounded number of signals, and an ACK whenever there are signals.
+func checkParse(t *testing.T, parse frameParser, event string, ackOK func(ack string) bool) (signals []interface{}, ack string) {
+	signals, ack, err := parse(event, "1")
+	if err != nil {
+		return nil, ""
+	}
+	if len(signals) > maxSiaEvents {
+		t.Fatalf("%d signals from %q", len(signals), event)
+	}
+	if len(signals) > 0 && ack == "" {
+		t.Fatalf("signals without ACK for %q", event)
+	}
+	if ack != "" && !ackOK(ack) {
+		t.Fatalf("unexpected ACK %q for %q", ack, event)
+	}
+	return signals, ack
+}
+
+// checkAckedPublished runs checkParse and asserts that every message that was
+// ACKed reaches operators, decoded or as an unparsed alarm, since the sender
+// will not send it again.
+func checkAckedPublished(t *testing.T, parse frameParser, event string, ackOK func(ack string) bool) {
+	if signals, ack := checkParse(t, parse, event, ackOK); ack != "" && !IsNak(ack) && len(signals) == 0 {
+		t.Fatalf("ACK %q without signals for %q", ack, event)
+	}
+}
+
+func byteAck(ack string) bool {
+	return ack == "\x06"
+}
+
+func byteAckOrNak(ack string) bool {
+	return ack == "\x06" || ack == "\x15"
+}
+
+// validDc09Ack checks the ACK carries its own CRC and length, with no line
+// breaks inside.
+func validDc09Ack(ack string) bool {
+	if !strings.HasPrefix(ack, "\n") || !strings.HasSuffix(ack, "[]\r") || len(ack) < 10 {
+		return false
+	}
+	frame := ack[1 : len(ack)-1]
+	return strings.HasPrefix(frame[8:], `"ACK"`) && frame == Dc09Frame(frame[8:]) && !strings.ContainsAny(frame, "\r\n")
+}
+
+// dc07Ack checks the ACK echoes a sequence number.
+func dc07Ack(ack string) bool {
+	isAck, _, ok := ParseDc07Reply(ack)
+	return ok && isAck && strings.HasPrefix(ack, "\n") && strings.HasSuffix(ack, "\r")
+}
+
+func FuzzParseSurguard(f *testing.F) {
+	addGoldenSeeds(f)
+	f.Fuzz(func(t *testing.T, event string) {
+		checkParse(t, ParseSurguard, event, byteAck)
+	})
+}
+
+func FuzzParseAdemco(f *testing.F) {
+	addGoldenSeeds(f)
+	f.Fuzz(func(t *testing.T, event string) {
+		checkParse(t, ParseAdemco, event, byteAck)
+	})
+}
+
+func FuzzParseDc09(f *testing.F) {
+	addGoldenSeeds(f)
+	f.Fuzz(func(t *testing.T, event string) {
+		checkAckedPublished(t, ParseDc09, event, validDc09Ack)
+	})
+}
+
+func FuzzParseTeknim(f *testing.F) {
+	addGoldenSeeds(f)
+	f.Fuzz(func(t *testing.T, event string) {
+		checkAckedPublished(t, ParseTeknim, event, byteAck)
+	})
+}
+
+func FuzzParseFonri(f *testing.F) {
+	addGoldenSeeds(f)
+	f.Fuzz(func(t *testing.T, event string) {
+		checkAckedPublished(t, ParseFonri, event, byteAck)
+	})
+}
+
+func FuzzParseRadionics(f *testing.F) {
+	addGoldenSeeds(f)
+	f.Fuzz(func(t *testing.T, event string) {
+		checkAckedPublished(t, ParseRadionics, event, byteAckOrNak)
+	})
+}
+
+func FuzzParseOh(f *testing.F) {
+	addGoldenSeeds(f)
+	f.Fuzz(func(t *testing.T, event string) {
+		checkAckedPublished(t, ParseOh, event, byteAck)
+	})
+}
+
+func FuzzParseDc07(f *testing.F) {
+	addGoldenSeeds(f)
+	f.Fuzz(func(t *testing.T, event string) {
+		checkAckedPublished(t, ParseDc07, event, dc07Ack)
+	})
+}
+
+// FuzzParsePayload covers the parsers of payloads that are answered by their
+// transport, bare Contact ID and SIA and ISAPI XML, so the ACK must stay empty.
+func FuzzParsePayload(f *testing.F) {
+	addGoldenSeeds(f)
+	f.Fuzz(func(t *testing.T, event string) {
+		for _, parse := range []frameParser{ParseCid, ParseSia, ParseIsapi} {
+			signals, ack, err := parse(event, "1")
+			if err != nil {
+				continue
+			}
+			if len(signals) > maxSiaEvents || ack != "" {
+				t.Fatalf("%d signals, ACK %q from %q", len(signals), ack, event)
+			}
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files from the current parser output")
+
+// goldenCase is one raw frame and what its parser must make of it. Signals are
+// kept as raw JSON, exactly as they are published.
+type goldenCase struct {
+	Name    string          `json:"name"`
+	Frame   string          `json:"frame"`
+	Ack     string          `json:"ack"`
+	Signals json.RawMessage `json:"signals"`
+}
+
+type frameParser func(event, receiverId string) ([]interface{}, string, error)
+
+var goldenParsers = map[string]frameParser{
+	"surguard":  ParseSurguard,
+	"ademco":    ParseAdemco,
+	"dc09":      ParseDc09,
+	"teknim":    ParseTeknim,
+	"fonri":     ParseFonri,
+	"radionics": ParseRadionics,
+	"oh":        ParseOh,
+	"cid":       ParseCid,
+	"sia":       ParseSia,
+	"isapi":     ParseIsapi,
+	"dc07":      ParseDc07,
+	"prosec": func(event, receiverId string) ([]interface{}, string, error) {
+		return parseDc09Builtin("prosec", event, receiverId)
+	},
+}
+
+// goldenTime is the clock of every golden signal.
+var goldenTime = time.Date(2024, 2, 21, 1, 7, 45, 0, time.UTC)
+
+func fixClock(t testing.TB) {
+	now = func() time.Time { return goldenTime }
+	t.Cleanup(func() { now = time.Now })
+}
+
+func loadGolden(t testing.TB, name string) []goldenCase {
+	data, err := os.ReadFile(filepath.Join("testdata", "golden", name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases []goldenCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		t.Fatalf("%s.json: %v", name, err)
+	}
+	return cases
+}
+
+func sameJSON(a, b []byte) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func TestGolden(t *testing.T) {
+	fixClock(t)
+
+	for name, parse := range goldenParsers {
+		cases := loadGolden(t, name)
+		for i, c := range cases {
+			t.Run(name+"/"+c.Name, func(t *testing.T) {
+				signals, ack, err := parse(c.Frame, "1")
+				if err != nil {
+					t.Fatalf("parse error: %v", err)
+				}
+				got, err := json.Marshal(signals)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if *update {
+					cases[i].Ack = ack
+					cases[i].Signals = got
+					return
+				}
+				if ack != c.Ack {
+					t.Errorf("ack = %q, want %q", ack, c.Ack)
+				}
+				if !sameJSON(got, c.Signals) {
+					t.Errorf("signals =\n%s\nwant\n%s", got, c.Signals)
+				}
+			})
+		}
+
+		if *update {
+			data, err := json.MarshalIndent(cases, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join("testdata", "golden", name+".json"), append(data, '\n'), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
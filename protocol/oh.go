@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"agent/model"
+	"fmt"
+)
+
+var ohRegexes = RegexSet{}
+
+/*
+Osborne-Hoffman (OH) network receiver output. A message names the receiver
+and line, the 6 digit account with the payload format, then the payload in
+brackets. XX is the receiver heartbeat, 18 and 98 Contact ID, SI SIA.
+
+	SR0001L0001    006969XX    [ID00000000]
+	SR0001L0002    00123418    [1130 01 003]
+	SR0001L0002    001234SI    [Nri1/BA004/BA005]
+*/
+func init() {
+	ohRegexes.add("mainRegex", `^SR(?<Receiver>\d{1,4})L(?<Line>\d{1,4})\s+(?<CustomerNumber>[0-9A-Fa-f]{6})(?<Format>XX|18|98|SI)\s+\[(?<Data>[^\]]*)\]\s*$`, true)
+	ohRegexes.add("ADM-CID", `^(?<EventType>[136])(?<Event>[0-9A-Fa-f]{3})\s?(?<Partition>[0-9A-Fa-f]{2})\s?(?<Zone>[0-9A-Fa-f]{3})$`, true)
+	ohRegexes.add("SIA-DCS", `^N?(?:ri(?<Partition>\d+)\/)?(?<Events>.+)$`, true)
+	registerParser("OH", ohRegexes, parseOh)
+}
+
+// ParseOh parses a frame with the built-in regexes.
+func ParseOh(event, receiverId string) (signal []interface{}, ack string, err error) {
+	return parseOh(ohRegexes, event, receiverId)
+}
+
+func parseOh(regexes RegexSet, event, receiverId string) (signal []interface{}, ack string, err error) {
+	fmt.Println("-----------------------------------------------------------------------")
+
+	mainData := regexes.apply("OH", event, "mainRegex")
+	if mainData == nil {
+		return nil, "", nil
+	}
+	// Messages we cannot decode are ACKed too and published as unparsed
+	ack = string([]byte{0x06})
+
+	base := model.AlarmSignal{
+		Type:             "event",
+		SideNo:           mainData["CustomerNumber"],
+		ReceiverId:       receiverId,
+		ReceiverNo:       mainData["Receiver"],
+		LineNo:           mainData["Line"],
+		MonitoringCenter: 1,
+		SignalDateTime:   now(),
+		RawSignal:        event,
+	}
+	switch mainData["Format"] {
+	case "XX":
+		signal = append(signal, model.PingSignal{
+			Type:             "ping",
+			ReceiverId:       receiverId,
+			MonitoringCenter: 1,
+			RawSignal:        event,
+		})
+	case "18", "98":
+		eventData := regexes.apply("OH", mainData["Data"], "ADM-CID")
+		if eventData == nil {
+			return append(signal, unparsedAlarm(base)), ack, nil
+		}
+		signal = append(signal, cidAlarm(base, eventData))
+	case "SI":
+		eventData := regexes.apply("OH", mainData["Data"], "SIA-DCS")
+		if eventData == nil {
+			return append(signal, unparsedAlarm(base)), ack, nil
+		}
+		base.PartNo = eventData["Partition"]
+		if signal = siaAlarms(base, eventData["Events"]); signal == nil {
+			signal = append(signal, unparsedAlarm(base))
+		}
+	}
+	return signal, ack, nil
+}
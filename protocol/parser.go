@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"agent/model"
+	"fmt"
+	"strings"
+)
+
+type parseFunc func(regexes RegexSet, event, receiverId string) (signal []interface{}, ack string, err error)
+
+// parserType is a service type with its built-in regexes.
+type parserType struct {
+	regexes RegexSet
+	parse   parseFunc
+}
+
+var parserTypes = map[string]parserType{}
+
+func registerParser(serviceType string, regexes RegexSet, parse parseFunc) {
+	parserTypes[serviceType] = parserType{regexes: regexes, parse: parse}
+}
+
+// Options are the per-service settings of a parser.
+type Options struct {
+	Profile     string           // DC-09 dialect, the type's own when empty
+	Regexes     []model.SubRegex // Overrides of the built-in regexes
+	CidChecksum string           // off, flag or nak, see CidChecksumFlag
+}
+
+// Parser decodes the frames of one service type. Each service gets its own,
+// so two services of the same type can run different regex overrides.
+type Parser struct {
+	Type        string
+	regexes     RegexSet
+	parse       parseFunc
+	cidChecksum string
+}
+
+// NewParser returns the parser of a service type with overrides applied on
+// top of the built-in regexes. DC-09 types take a profile, the type's own one
+// when empty. Invalid options are reported here, at load.
+func NewParser(serviceType string, opts Options) (*Parser, error) {
+	key := serviceType
+	if name, isDc09 := dc09Aliases[serviceType]; isDc09 {
+		if opts.Profile != "" {
+			name = opts.Profile
+		}
+		if _, exists := dc09Profiles[name]; !exists {
+			return nil, fmt.Errorf("%s: unknown DC-09 profile %s, expected one of %s", serviceType, name, strings.Join(dc09ProfileNames, ", "))
+		}
+		key = "DC09/" + name
+	} else if opts.Profile != "" {
+		return nil, fmt.Errorf("%s: profiles only apply to DC-09 services", serviceType)
+	}
+
+	t, exists := parserTypes[key]
+	if !exists {
+		return nil, fmt.Errorf("unknown service type %s", serviceType)
+	}
+	regexes, err := t.regexes.Override(opts.Regexes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", serviceType, err)
+	}
+
+	switch opts.CidChecksum {
+	case "":
+		opts.CidChecksum = CidChecksumFlag
+	case CidChecksumOff, CidChecksumFlag, CidChecksumNak:
+	default:
+		return nil, fmt.Errorf("%s: cidChecksum must be off, flag or nak, not %q", serviceType, opts.CidChecksum)
+	}
+	return &Parser{Type: serviceType, regexes: regexes, parse: t.parse, cidChecksum: opts.CidChecksum}, nil
+}
+
+func (p *Parser) Parse(event, receiverId string) (signal []interface{}, ack string, err error) {
+	signal, ack, err = p.parse(p.regexes, event, receiverId)
+	if err != nil {
+		return signal, ack, err
+	}
+	signal, ack = enforceCidChecksum(p.cidChecksum, signal, ack)
+	return signal, ack, nil
+}
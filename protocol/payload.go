@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"agent/model"
+	"fmt"
+)
+
+var (
+	cidRegexes = RegexSet{}
+	siaRegexes = RegexSet{}
+)
+
+/*
+Bare Contact ID and SIA event strings, as IoT gateways publish them without
+any receiver framing. The account may be left out when the transport
+carries it, e.g. in the MQTT topic. There is nothing to answer, the ACK is
+always empty.
+
+	CID   12341811300100388         raw, checksum checked
+	      1234 18 1130 01 003
+	      #1234|1130 01 003
+	      1130 01 003
+	SIA   #1234|Nri1/BA004/BA005
+	      [#1234|NBA004]
+	      Nri1/OP001
+*/
+func init() {
+	cidRegexes.add("CID", `^(?<Cid>(?<CustomerNumber>[0-9A-Fa-f]{4})(?:18|98)(?<EventType>[136])(?<Event>[0-9A-Fa-f]{3})(?<Partition>[0-9A-Fa-f]{2})(?<Zone>[0-9A-Fa-f]{3})[0-9A-Fa-f])$`, true)
+	cidRegexes.add("CID", `^\[?(?:#?(?<CustomerNumber>[0-9A-Fa-f]{1,16})(?:\s*\|\s*|\s+))?(?:(?:18|98)\s+)?(?<EventType>[136])(?<Event>[0-9A-Fa-f]{3})\s?(?<Partition>[0-9A-Fa-f]{2})\s?(?<Zone>[0-9A-Fa-f]{3})\]?$`, true)
+	registerParser("CID", cidRegexes, parseCid)
+
+	siaRegexes.add("SIA", `^\[?(?:#?(?<CustomerNumber>[0-9A-Fa-f]{1,16})\|)?N(?:ri(?<Partition>\d+)\/)?(?<Events>[A-Z]{2}[^\[\]]*)\]?$`, true)
+	registerParser("SIA", siaRegexes, parseSia)
+}
+
+func payloadBase(event, receiverId, account string) model.AlarmSignal {
+	return model.AlarmSignal{
+		Type:             "event",
+		SideNo:           account,
+		ReceiverId:       receiverId,
+		MonitoringCenter: 1,
+		SignalDateTime:   now(),
+		RawSignal:        event,
+	}
+}
+
+// ParseCid parses a Contact ID string with the built-in regexes.
+func ParseCid(event, receiverId string) (signal []interface{}, ack string, err error) {
+	return parseCid(cidRegexes, event, receiverId)
+}
+
+func parseCid(regexes RegexSet, event, receiverId string) (signal []interface{}, ack string, err error) {
+	fmt.Println("-----------------------------------------------------------------------")
+	data := regexes.apply("CID", event, "CID")
+	if data == nil {
+		return nil, "", nil
+	}
+	signal = append(signal, cidAlarm(payloadBase(event, receiverId, data["CustomerNumber"]), data))
+	return signal, "", nil
+}
+
+// ParseSia parses a SIA event string with the built-in regexes.
+func ParseSia(event, receiverId string) (signal []interface{}, ack string, err error) {
+	return parseSia(siaRegexes, event, receiverId)
+}
+
+func parseSia(regexes RegexSet, event, receiverId string) (signal []interface{}, ack string, err error) {
+	fmt.Println("-----------------------------------------------------------------------")
+	data := regexes.apply("SIA", event, "SIA")
+	if data == nil {
+		return nil, "", nil
+	}
+	base := payloadBase(event, receiverId, data["CustomerNumber"])
+	base.PartNo = data["Partition"]
+	return siaAlarms(base, data["Events"]), "", nil
+}
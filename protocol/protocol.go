@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"agent/model"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// now is the clock used for signal and ACK times.
+var now = time.Now
+
+// siaUserEvents are the SIA codes whose number is a user, not a zone.
+var siaUserEvents = map[string]bool{
+	"OP": true, "CL": true, "OA": true, "CA": true, "OG": true, "CG": true,
+	"OR": true, "CR": true, "OS": true, "CS": true, "JA": true, "DG": true,
+}
+
+// userNumber returns the user an event is about, empty when the number is a
+// zone. Contact ID open/close, access and arming events (40x, 42x, 44x, 45x)
+// and the SIA opening and closing codes carry the user in the zone field.
+func userNumber(code, zone string) string {
+	if len(code) == 4 && (code[0] == 'E' || code[0] == 'R') {
+		switch code[1:3] {
+		case "40", "42", "44", "45":
+			return zone
+		}
+		return ""
+	}
+	if siaUserEvents[code] {
+		return zone
+	}
+	return ""
+}
+
+// IsNak reports whether an answer refuses the message it answers: the NAK
+// control character of Contact ID and Radionics, or a SIA DC-07/DC-09 "NAK".
+func IsNak(ack string) bool {
+	return strings.HasPrefix(ack, "\x15") || strings.Contains(ack, `"NAK"`)
+}
+
+// unparsedAlarm stands for a message that is ACKed although its event data did
+// not decode, so that it reaches operators instead of being lost: base with
+// the unparsed type, no event code and the message in RawSignal.
+func unparsedAlarm(base model.AlarmSignal) model.AlarmSignal {
+	fmt.Println("Undecoded event data:", base.RawSignal)
+	base.Type = model.UnparsedType
+	return base
+}
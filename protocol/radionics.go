@@ -0,0 +1,144 @@
+package protocol
+
+import (
+	"agent/model"
+	"fmt"
+)
+
+var radionicsRegexes = RegexSet{}
+
+/*
+Radionics D6500 computer interface, also sent by the D6600 in 6500 mode. A
+record is its type letter, the receiver (2 digits) and line (1 digit), then
+the data. Every record waits for ACK (0x06); NAK (0x15) makes the receiver
+send it again, so it is only sent for records garbled on the line.
+
+	Modem II/IIIa  M011 1234 AL 003
+	BFSK           A011 123 31
+	Contact ID     C011 1234 1130 01 003
+	SIA            S011 [#1234|Nri1/BA004]
+	Heartbeat      H01
+*/
+func init() {
+	radionicsRegexes.add("MODEM", `^M(?<Receiver>\d{2})(?<Line>\d)\s+(?<CustomerNumber>[0-9A-Fa-f]{3,6})\s+(?<Event>[A-Z]{2})\s*(?<Zone>\d{0,4})\s*$`, true)
+	radionicsRegexes.add("BFSK", `^A(?<Receiver>\d{2})(?<Line>\d)\s+(?<CustomerNumber>[0-9A-Fa-f]{3,4})\s+(?<Event>[0-9A-Fa-f])(?<Zone>[0-9A-Fa-f])\s*$`, true)
+	radionicsRegexes.add("ADM-CID", `^C(?<Receiver>\d{2})(?<Line>\d)\s+(?<CustomerNumber>[0-9A-Fa-f]{4,6})\s+(?<EventType>[136])(?<Event>[0-9A-Fa-f]{3})\s?(?<Partition>[0-9A-Fa-f]{2})\s?(?<Zone>[0-9A-Fa-f]{3})\s*$`, true)
+	radionicsRegexes.add("SIA-DCS", `^S(?<Receiver>\d{2})(?<Line>\d)\s+\[#?(?<CustomerNumber>[0-9A-Fa-f]+)\|N(?:ri(?<Partition>\d+)\/)?(?<Events>[^\]]+)\]\s*$`, true)
+	radionicsRegexes.add("HEARTBEAT", `^H(?<Receiver>\d{2})\s*$`, true)
+	registerParser("RADIONICS", radionicsRegexes, parseRadionics)
+}
+
+// radionicsEvents maps the Modem II/IIIa event letters to SIA codes. Letters
+// not listed are passed on as sent.
+var radionicsEvents = map[string]string{
+	"AL": "BA", // Alarm
+	"RS": "BR", // Restoral
+	"FA": "FA", // Fire alarm
+	"FR": "FH", // Fire restoral
+	"PA": "PA", // Panic
+	"DU": "HA", // Duress
+	"TB": "BT", // Trouble
+	"TR": "BJ", // Trouble restoral
+	"OP": "OP", // Opening
+	"CL": "CL", // Closing
+	"CN": "BC", // Cancel
+	"AC": "AT", // AC fail
+	"AR": "AR", // AC restoral
+	"LB": "YT", // Low battery
+	"TS": "RP", // Test report
+}
+
+var (
+	radionicsAck = string([]byte{0x06})
+	radionicsNak = string([]byte{0x15})
+)
+
+// ParseRadionics parses a frame with the built-in regexes.
+func ParseRadionics(event, receiverId string) (signal []interface{}, ack string, err error) {
+	return parseRadionics(radionicsRegexes, event, receiverId)
+}
+
+func parseRadionics(regexes RegexSet, event, receiverId string) (signal []interface{}, ack string, err error) {
+	fmt.Println("-----------------------------------------------------------------------")
+
+	if event == "" {
+		return nil, "", nil
+	}
+	// The receiver repeats what we NAK, forever for a record it cannot send
+	// differently. Records we do not know are ACKed and published unparsed.
+	if radionicsGarbled(event) {
+		fmt.Println("Garbled Radionics record", event)
+		return nil, radionicsNak, nil
+	}
+	alarm := model.AlarmSignal{
+		Type:             "event",
+		ReceiverId:       receiverId,
+		MonitoringCenter: 1,
+		SignalDateTime:   now(),
+		RawSignal:        event,
+	}
+	var rule string
+	switch event[0] {
+	case 'M':
+		rule = "MODEM"
+	case 'A':
+		rule = "BFSK"
+	case 'C':
+		rule = "ADM-CID"
+	case 'S':
+		rule = "SIA-DCS"
+	case 'H':
+		rule = "HEARTBEAT"
+	default:
+		fmt.Println("Unknown Radionics record", event)
+		return append(signal, unparsedAlarm(alarm)), radionicsAck, nil
+	}
+	data := regexes.apply("RADIONICS", event, rule)
+	if data == nil {
+		return append(signal, unparsedAlarm(alarm)), radionicsAck, nil
+	}
+
+	alarm.SideNo = data["CustomerNumber"]
+	alarm.ReceiverNo = data["Receiver"]
+	alarm.LineNo = data["Line"]
+	alarm.PartNo = data["Partition"]
+	alarm.Zone = data["Zone"]
+	switch rule {
+	case "MODEM":
+		alarm.EventCode = data["Event"]
+		if code, exists := radionicsEvents[data["Event"]]; exists {
+			alarm.EventCode = code
+		}
+		alarm.UserNo = userNumber(alarm.EventCode, alarm.Zone)
+		signal = append(signal, alarm)
+	case "BFSK":
+		// BFSK event and zone digits are programmed per panel, passed on as sent
+		alarm.EventCode = data["Event"] + data["Zone"]
+		signal = append(signal, alarm)
+	case "ADM-CID":
+		signal = append(signal, cidAlarm(alarm, data))
+	case "SIA-DCS":
+		if signal = siaAlarms(alarm, data["Events"]); signal == nil {
+			signal = append(signal, unparsedAlarm(alarm))
+		}
+	case "HEARTBEAT":
+		signal = append(signal, model.PingSignal{
+			Type:             "ping",
+			ReceiverId:       receiverId,
+			MonitoringCenter: 1,
+			RawSignal:        event,
+		})
+	}
+	return signal, radionicsAck, nil
+}
+
+// radionicsGarbled reports whether a record has bytes the receiver never
+// sends, a sign it was corrupted on the line.
+func radionicsGarbled(event string) bool {
+	for i := 0; i < len(event); i++ {
+		if c := event[i]; (c < ' ' && c != '\t' && c != '\r' && c != '\n') || c > '~' {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package protocol
+
+import (
+	"agent/model"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RegexSet holds the sub-regexes of one parser by rule name. A rule may have
+// several alternatives, tried in order until an active one matches, like the
+// two Sur-Gard ADM-CID layouts.
+type RegexSet map[string][]*model.SubRegex
+
+// add registers a built-in alternative; a broken built-in regex is fatal.
+func (set RegexSet) add(name, regexText string, isActive bool) {
+	compiledRegex, err := regexp.Compile(regexText)
+	if err != nil {
+		log.Fatalf("Regex derlenirken hata oluştu: %v", err)
+	}
+	set[name] = append(set[name], &model.SubRegex{
+		Name:          name,
+		RegexText:     regexText,
+		IsActive:      &isActive,
+		CompiledRegex: compiledRegex,
+	})
+}
+
+// apply matches eventStr against the alternatives of a rule and returns the
+// named groups of the first match, nil when none matches.
+func (set RegexSet) apply(parser, eventStr, rule string) map[string]string {
+	alternatives, exists := set[rule]
+	if !exists {
+		fmt.Printf("No regex found for %s, %s\n", eventStr, rule)
+		return nil
+	}
+
+	for i, regex := range alternatives {
+		if !regex.Active() {
+			continue
+		}
+		name := rule
+		if len(alternatives) > 1 {
+			name = fmt.Sprintf("%s-%d", rule, i+1)
+		}
+
+		match := regex.CompiledRegex.FindStringSubmatch(eventStr)
+		trace(parser, name, match != nil)
+		if match == nil {
+			continue
+		}
+
+		result := make(map[string]string)
+		for i, name := range regex.CompiledRegex.SubexpNames() {
+			if i != 0 && name != "" { // İlk eleman tam eşleşmeyi içerir ve isimsizdir
+				if name == "EventType" {
+					if match[i] == "1" {
+						match[i] = "E"
+					} else if match[i] == "3" {
+						match[i] = "R"
+					}
+				}
+				result[name] = match[i]
+			}
+		}
+		return result
+	}
+
+	fmt.Println("No match found", "GELEN=", eventStr, "RULE", rule)
+	return nil
+}
+
+// requiredGroups are the named groups every built-in alternative of a rule
+// captures. The parser code relies on them, so overrides must capture them too.
+func (set RegexSet) requiredGroups(rule string) map[string]bool {
+	var required map[string]bool
+	for _, regex := range set[rule] {
+		groups := map[string]bool{}
+		for _, name := range regex.CompiledRegex.SubexpNames() {
+			if name != "" && (required == nil || required[name]) {
+				groups[name] = true
+			}
+		}
+		required = groups
+	}
+	return required
+}
+
+// Override returns a copy of the set where every rule named in defs is
+// replaced by the alternatives from defs, in their order. Rules not named keep
+// their built-in regexes; listing a rule with IsActive false switches it off,
+// leaving IsActive out keeps it on.
+func (set RegexSet) Override(defs []model.SubRegex) (RegexSet, error) {
+	result := RegexSet{}
+	for rule, alternatives := range set {
+		result[rule] = alternatives
+	}
+
+	replaced := map[string]bool{}
+	for _, def := range defs {
+		if _, exists := set[def.Name]; !exists {
+			return nil, fmt.Errorf("unknown regex rule %q", def.Name)
+		}
+		compiledRegex, err := regexp.Compile(def.RegexText)
+		if err != nil {
+			return nil, fmt.Errorf("regex %s: %w", def.Name, err)
+		}
+
+		groups := map[string]bool{}
+		for _, name := range compiledRegex.SubexpNames() {
+			groups[name] = true
+		}
+		for name := range set.requiredGroups(def.Name) {
+			if !groups[name] {
+				return nil, fmt.Errorf("regex %s: missing named group %s", def.Name, name)
+			}
+		}
+
+		if !replaced[def.Name] {
+			result[def.Name] = nil
+			replaced[def.Name] = true
+		}
+		result[def.Name] = append(result[def.Name], &model.SubRegex{
+			Name:          def.Name,
+			RegexText:     def.RegexText,
+			IsActive:      def.IsActive,
+			CompiledRegex: compiledRegex,
+		})
+	}
+	return result, nil
+}
+
+// LoadRegexFile reads regex definitions from a JSON or YAML file, a list of
+// {Name, RegexText, IsActive} entries.
+func LoadRegexFile(path string) ([]model.SubRegex, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var defs []model.SubRegex
+	if filepath.Ext(path) == ".json" {
+		err = json.Unmarshal(data, &defs)
+	} else {
+		err = yaml.Unmarshal(data, &defs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return defs, nil
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"agent/model"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func active(on bool) *bool { return &on }
+
+func TestRegexOverride(t *testing.T) {
+	fixClock(t)
+	frame := "501001 181234E13001003"
+
+	tests := []struct {
+		name      string
+		defs      []model.SubRegex
+		wantErr   string
+		wantEvent string
+	}{
+		{name: "built-in", wantEvent: "E130"},
+		{
+			name: "fallback order",
+			defs: []model.SubRegex{
+				{Name: "ADM-CID", RegexText: `^X(?<Receiver>)(?<ContactCode>)(?<CustomerNumber>)(?<EventType>)(?<Event>)(?<Partition>)(?<Zone>)`, IsActive: active(true)},
+				{Name: "ADM-CID", RegexText: `5(?<Receiver>\d{2})(?<Line>\d{3}) (?<ContactCode>18)(?<CustomerNumber>\d{4})(?<EventType>[ER])(?<Event>\d{3})(?<Partition>\d{2})(?<Zone>\d{3})`, IsActive: active(true)},
+			},
+			wantEvent: "E130",
+		},
+		{
+			name:      "inactive rule",
+			defs:      []model.SubRegex{{Name: "ADM-CID", RegexText: surguardRegexes["ADM-CID"][1].RegexText, IsActive: active(false)}},
+			wantEvent: "",
+		},
+		{
+			name:      "flag left out",
+			defs:      []model.SubRegex{{Name: "ADM-CID", RegexText: surguardRegexes["ADM-CID"][1].RegexText}},
+			wantEvent: "E130",
+		},
+		{name: "unknown rule", defs: []model.SubRegex{{Name: "ADM-CID-9", RegexText: `x`}}, wantErr: "unknown regex rule"},
+		{name: "bad regex", defs: []model.SubRegex{{Name: "TEL", RegexText: `(`}}, wantErr: "missing closing )"},
+		{name: "missing group", defs: []model.SubRegex{{Name: "TEL", RegexText: `4(?<CustomerNumber>.*)`}}, wantErr: "missing named group"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser, err := NewParser("SURGUARD", Options{Regexes: tt.defs})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signals, _, _ := parser.Parse(frame, "1")
+			event := ""
+			if len(signals) > 0 {
+				event = signals[0].(model.AlarmSignal).EventCode
+			}
+			if event != tt.wantEvent {
+				t.Errorf("event = %q, want %q", event, tt.wantEvent)
+			}
+		})
+	}
+}
+
+func TestLoadRegexFileDefaultsActive(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"rules.yaml": "- name: ADM-CID\n  regexText: x\n- name: TEL\n  regexText: y\n  isActive: false\n",
+		"rules.json": `[{"Name":"ADM-CID","RegexText":"x"},{"Name":"TEL","RegexText":"y","IsActive":false}]`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		defs, err := LoadRegexFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(defs) != 2 || !defs[0].Active() || defs[1].Active() {
+			t.Errorf("%s: active flags of %+v", name, defs)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"agent/model"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// SIA DC-03/DC-04 event blocks, shared by every parser that carries SIA.
+
+// maxSiaEvents bounds the signals a single SIA event block can produce.
+const maxSiaEvents = 64
+
+var siaCodeOnly = regexp.MustCompile(`^[A-Z]{2}$`)
+
+type siaEvent struct {
+	code string
+	zone string
+}
+
+// splitSiaEvents splits a SIA event block like "BA003/BA004". A bare two letter
+// code like "RP" is an event without a zone; other tokens without an event
+// code and zone are dropped instead of becoming empty signals.
+func splitSiaEvents(events string) []siaEvent {
+	var result []siaEvent
+	for _, e := range strings.Split(events, "/") {
+		code, zone := model.SiaEventOrZone(e)
+		if code == "" && siaCodeOnly.MatchString(e) {
+			code = e
+		}
+		if code == "" {
+			continue
+		}
+		if len(result) == maxSiaEvents {
+			fmt.Printf("More than %d SIA events, ignoring the rest: %s\n", maxSiaEvents, events)
+			break
+		}
+		result = append(result, siaEvent{code: code, zone: zone})
+	}
+	return result
+}
+
+// siaAlarms returns one alarm per event of a SIA event block, each a copy of
+// base with the event code, zone and user filled in.
+func siaAlarms(base model.AlarmSignal, events string) (signal []interface{}) {
+	for _, e := range splitSiaEvents(events) {
+		fmt.Println("events", e)
+		alarm := base
+		alarm.EventCode = e.code
+		alarm.Zone = e.zone
+		alarm.UserNo = userNumber(e.code, e.zone)
+		signal = append(signal, alarm)
+	}
+	return signal
+}
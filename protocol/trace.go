@@ -0,0 +1,12 @@
+package protocol
+
+// Trace, when set, is told about every sub-regex a parser tries on a frame and
+// whether it matched. The offline parse command uses it to show which rule
+// decoded a frame; the receiver leaves it nil.
+var Trace func(parser, rule string, matched bool)
+
+func trace(parser, rule string, matched bool) {
+	if Trace != nil {
+		Trace(parser, rule, matched)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"agent/model"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultRateWindow = time.Minute
+
+// floodTickInterval is how often floods are checked for a quiet window, so
+// their end is published even when no further signal comes in.
+const floodTickInterval = time.Second
+
+// RateLimitConfig caps how many alarm signals are published per window. Signals
+// over the limit are still ACKed and counted but not published, so a panel
+// with a faulty zone neither floods operators nor retries endlessly.
+type RateLimitConfig struct {
+	Window        time.Duration `yaml:"window"`        // Default 1m
+	PerAccount    int           `yaml:"perAccount"`    // Signals per account and window, 0 is unlimited
+	PerConnection int           `yaml:"perConnection"` // Signals per connection and window, 0 is unlimited
+}
+
+func (c RateLimitConfig) window() time.Duration {
+	if c.Window <= 0 {
+		return defaultRateWindow
+	}
+	return c.Window
+}
+
+// floodWindow counts signals in fixed windows. A flood starts with the first
+// signal over the limit and ends after a window that stayed within it.
+type floodWindow struct {
+	start      time.Time
+	count      int
+	suppressed int
+	flooding   bool
+}
+
+// hit counts one signal. started is true only for the signal that begins a
+// flood; ended reports how many signals the previous flood suppressed when it
+// is over, 0 otherwise.
+func (w *floodWindow) hit(now time.Time, window time.Duration, limit int) (allowed, started bool, ended int) {
+	ended = w.expire(now, window, limit)
+	if now.Sub(w.start) >= window {
+		w.start = now
+		w.count = 0
+	}
+
+	w.count++
+	if w.count <= limit {
+		return true, false, ended
+	}
+	started = !w.flooding
+	w.flooding = true
+	w.suppressed++
+	return false, started, ended
+}
+
+// expire ends the flood once its window is over and stayed within the limit,
+// or a whole window passed after it without signals. It returns how many
+// signals the flood suppressed, 0 when it goes on or there is none.
+func (w *floodWindow) expire(now time.Time, window time.Duration, limit int) (ended int) {
+	elapsed := now.Sub(w.start)
+	if !w.flooding || elapsed < window || (w.count > limit && elapsed < 2*window) {
+		return 0
+	}
+	ended = w.suppressed
+	w.flooding = false
+	w.suppressed = 0
+	return ended
+}
+
+// accountLimiter keeps the per-account windows of one service, shared by all
+// of its connections.
+type accountLimiter struct {
+	service ServiceConfig
+
+	mu        sync.Mutex // Also guards the flood of the sessions of the service
+	accounts  map[string]*floodWindow
+	flooding  map[*session]bool // Sessions in a per-connection flood, for expire
+	lastPrune time.Time
+}
+
+var (
+	accountLimitersMu sync.Mutex
+	accountLimiters   = map[string]*accountLimiter{}
+)
+
+func accountLimiterFor(service ServiceConfig) *accountLimiter {
+	accountLimitersMu.Lock()
+	defer accountLimitersMu.Unlock()
+
+	l, exists := accountLimiters[service.Name]
+	if !exists {
+		l = &accountLimiter{service: service, accounts: map[string]*floodWindow{}, flooding: map[*session]bool{}}
+		accountLimiters[service.Name] = l
+	}
+	return l
+}
+
+func (l *accountLimiter) hit(account string, now time.Time) (allowed, started bool, ended int) {
+	config := l.service.RateLimit
+	if config.PerAccount <= 0 {
+		return true, false, 0
+	}
+	window := config.window()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Forget accounts that have been quiet for a while
+	if now.Sub(l.lastPrune) >= 2*window {
+		for key, w := range l.accounts {
+			if !w.flooding && now.Sub(w.start) >= 2*window {
+				delete(l.accounts, key)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	w, exists := l.accounts[account]
+	if !exists {
+		w = &floodWindow{start: now}
+		l.accounts[account] = w
+	}
+	return w.hit(now, window, config.PerAccount)
+}
+
+// hitConnection counts one signal of account against the per-connection limit
+// of s, and remembers the account when it starts a flood.
+func (l *accountLimiter) hitConnection(s *session, account string, now time.Time) (allowed, started bool, ended int) {
+	config := s.service.RateLimit
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	allowed, started, ended = s.flood.hit(now, config.window(), config.PerConnection)
+	if started {
+		s.floodAccount = account
+	}
+	if s.flood.flooding {
+		l.flooding[s] = true
+	} else {
+		delete(l.flooding, s)
+	}
+	return allowed, started, ended
+}
+
+// expire ends the floods of accounts and connections that went quiet and
+// returns their RUNAWAY_END signals.
+func (l *accountLimiter) expire(now time.Time) []interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var signals []interface{}
+	if config := l.service.RateLimit; config.PerAccount > 0 {
+		for account, w := range l.accounts {
+			if ended := w.expire(now, config.window(), config.PerAccount); ended > 0 {
+				signals = append(signals, accountCalmed(l.service, account, ended, "", now))
+			}
+		}
+	}
+	for s := range l.flooding {
+		config := s.service.RateLimit
+		if ended := s.flood.expire(now, config.window(), config.PerConnection); ended > 0 {
+			signals = append(signals, connectionCalmed(s, ended, "", now))
+			delete(l.flooding, s)
+		}
+	}
+	return signals
+}
+
+// endQuietFloods ends the floods of all services whose panels went quiet, every
+// floodTickInterval, and delivers their RUNAWAY_END signals.
+func endQuietFloods() {
+	for now := range time.Tick(floodTickInterval) {
+		signals := expireFloods(now)
+		if len(signals) == 0 {
+			continue
+		}
+		if err := publish(signals, nil); err != nil {
+			fmt.Printf("Failed to publish the end of %d floods: %v\n", len(signals), err)
+			continue
+		}
+		for _, channel := range outputs {
+			channel.Send(signals)
+		}
+	}
+}
+
+func expireFloods(now time.Time) []interface{} {
+	accountLimitersMu.Lock()
+	limiters := make([]*accountLimiter, 0, len(accountLimiters))
+	for _, l := range accountLimiters {
+		limiters = append(limiters, l)
+	}
+	accountLimitersMu.Unlock()
+
+	var signals []interface{}
+	for _, l := range limiters {
+		signals = append(signals, l.expire(now)...)
+	}
+	return signals
+}
+
+// Event codes of the signals flood detection adds
+const (
+	runawayEvent    = "RUNAWAY"     // A flood started, further signals are suppressed
+	runawayEndEvent = "RUNAWAY_END" // The flood is over, Text tells how many signals it suppressed
+)
+
+// limitSignals drops alarm signals over the account and connection limits.
+// A flood adds one runaway signal when it starts and one with the number of
+// suppressed signals once it is over, here or from endQuietFloods when no
+// signal follows. Pings and phone reports are never
+// limited.
+func limitSignals(s *session, signals []interface{}, rawSignal string) []interface{} {
+	return limitSignalsAt(s, signals, rawSignal, time.Now())
+}
+
+func limitSignalsAt(s *session, signals []interface{}, rawSignal string, now time.Time) []interface{} {
+	config := s.service.RateLimit
+	if config.PerAccount <= 0 && config.PerConnection <= 0 {
+		return signals
+	}
+
+	result := make([]interface{}, 0, len(signals))
+	for _, signal := range signals {
+		if _, ok := signal.(model.AlarmSignal); !ok {
+			result = append(result, signal)
+			continue
+		}
+		account := model.SignalAccount(signal)
+
+		if config.PerConnection > 0 {
+			allowed, started, ended := s.limiter.hitConnection(s, account, now)
+			if ended > 0 {
+				result = append(result, connectionCalmed(s, ended, rawSignal, now))
+			}
+			if !allowed {
+				countSuppressed(s.service)
+				if started {
+					// The whole link is held back, so tell operators which panel tripped it
+					fmt.Printf("Connection %s for service %s is flooding, suppressing signals\n", s.remote, s.service.Name)
+					countRunaway(s.service)
+					text := fmt.Sprintf("Connection %s is flooding, its signals are suppressed", s.remote)
+					result = append(result, floodSignal(s.service, account, runawayEvent, text, rawSignal, now))
+				}
+				continue
+			}
+		}
+
+		allowed, started, ended := s.limiter.hit(account, now)
+		if ended > 0 {
+			result = append(result, accountCalmed(s.service, account, ended, rawSignal, now))
+		}
+		if allowed {
+			result = append(result, signal)
+			continue
+		}
+		countSuppressed(s.service)
+		if started {
+			fmt.Printf("Account %s for service %s is a runaway panel, suppressing signals\n", account, s.service.Name)
+			countRunaway(s.service)
+			text := fmt.Sprintf("Account %s is a runaway panel, its signals are suppressed", account)
+			result = append(result, floodSignal(s.service, account, runawayEvent, text, rawSignal, now))
+		}
+	}
+	return result
+}
+
+func accountCalmed(service ServiceConfig, account string, ended int, rawSignal string, now time.Time) model.AlarmSignal {
+	fmt.Printf("Account %s for service %s calmed down, %d signals were suppressed\n", account, service.Name, ended)
+	text := fmt.Sprintf("Account %s calmed down, %d signals were suppressed", account, ended)
+	return floodSignal(service, account, runawayEndEvent, text, rawSignal, now)
+}
+
+func connectionCalmed(s *session, ended int, rawSignal string, now time.Time) model.AlarmSignal {
+	fmt.Printf("Connection %s for service %s calmed down, %d signals were suppressed\n", s.remote, s.service.Name, ended)
+	text := fmt.Sprintf("Connection %s calmed down, %d signals were suppressed", s.remote, ended)
+	return floodSignal(s.service, s.floodAccount, runawayEndEvent, text, rawSignal, now)
+}
+
+func floodSignal(service ServiceConfig, account, eventCode, text, rawSignal string, now time.Time) model.AlarmSignal {
+	return model.AlarmSignal{
+		Type:             "runaway",
+		SideNo:           account,
+		ReceiverId:       strconv.Itoa(service.Id),
+		MonitoringCenter: 1,
+		SignalDateTime:   now,
+		EventCode:        eventCode,
+		Text:             text,
+		RawSignal:        rawSignal,
+	}
+}
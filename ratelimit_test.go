@@ -0,0 +1,206 @@
+package main
+
+import (
+	"agent/model"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFloodWindowHit(t *testing.T) {
+	start := time.Date(2024, 2, 21, 1, 0, 0, 0, time.UTC)
+	w := floodWindow{start: start}
+	for i, tt := range []struct {
+		at      time.Duration
+		allowed bool
+		started bool
+		ended   int
+	}{
+		{0, true, false, 0},
+		{time.Second, true, false, 0},
+		{2 * time.Second, false, true, 0}, // Third in the window starts the flood
+		{3 * time.Second, false, false, 0},
+		// A new window lets the limit through again, the flood goes on
+		{61 * time.Second, true, false, 0},
+		{62 * time.Second, true, false, 0},
+		{63 * time.Second, false, false, 0},
+		// That window went over the limit too, the flood is not over yet
+		{121 * time.Second, true, false, 0},
+		// A window within the limit ends it
+		{181 * time.Second, true, false, 3},
+		{182 * time.Second, true, false, 0},
+		{183 * time.Second, false, true, 0},
+		// Two windows of silence end it as well
+		{303 * time.Second, true, false, 1},
+	} {
+		allowed, started, ended := w.hit(start.Add(tt.at), time.Minute, 2)
+		if allowed != tt.allowed || started != tt.started || ended != tt.ended {
+			t.Errorf("hit %d at %s: got %t, %t, %d; want %t, %t, %d",
+				i, tt.at, allowed, started, ended, tt.allowed, tt.started, tt.ended)
+		}
+	}
+}
+
+func limitedSession(name string, config RateLimitConfig) *session {
+	service := ServiceConfig{Name: name, Id: 4, RateLimit: config}
+	return &session{remote: "10.0.0.9:4000", service: service, limiter: accountLimiterFor(service)}
+}
+
+func alarms(accounts ...string) []interface{} {
+	signals := make([]interface{}, 0, len(accounts))
+	for _, account := range accounts {
+		signals = append(signals, model.AlarmSignal{Type: "event", SideNo: account, EventCode: "E130"})
+	}
+	return signals
+}
+
+// summary lists the account and event code of each signal, "ping" for pings.
+func summary(signals []interface{}) string {
+	var parts []string
+	for _, signal := range signals {
+		switch s := signal.(type) {
+		case model.AlarmSignal:
+			parts = append(parts, s.SideNo+":"+s.EventCode)
+		case model.PingSignal:
+			parts = append(parts, "ping")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// limitCall is one batch of signals passed to limitSignals and what is left of it.
+type limitCall struct {
+	at      time.Duration
+	signals []interface{}
+	want    string
+}
+
+func TestLimitSignals(t *testing.T) {
+	start := time.Date(2024, 2, 21, 1, 0, 0, 0, time.UTC)
+	ping := model.PingSignal{Type: "ping", SideNo: "1234"}
+
+	for _, tt := range []struct {
+		name   string
+		config RateLimitConfig
+		calls  []limitCall
+	}{
+		{
+			name:   "unlimited",
+			config: RateLimitConfig{},
+			calls: []limitCall{
+				{0, alarms("1234", "1234", "1234"), "1234:E130 1234:E130 1234:E130"},
+			},
+		},
+		{
+			name:   "per account",
+			config: RateLimitConfig{PerAccount: 2},
+			calls: []limitCall{
+				{0, append(alarms("1234", "1234", "1234", "5678"), ping), "1234:E130 1234:E130 1234:RUNAWAY 5678:E130 ping"},
+				{time.Second, append(alarms("1234", "1234"), ping, ping), "ping ping"},
+				{2 * time.Minute, alarms("1234"), "1234:RUNAWAY_END 1234:E130"},
+			},
+		},
+		{
+			name:   "per connection",
+			config: RateLimitConfig{PerConnection: 3},
+			calls: []limitCall{
+				{0, alarms("1111", "2222", "3333", "4444", "5555"), "1111:E130 2222:E130 3333:E130 4444:RUNAWAY"},
+				{time.Second, append(alarms("1111"), ping), "ping"},
+				{2 * time.Minute, alarms("2222"), "4444:RUNAWAY_END 2222:E130"},
+			},
+		},
+		{
+			name:   "both limits",
+			config: RateLimitConfig{PerAccount: 1, PerConnection: 3},
+			calls: []limitCall{
+				{0, alarms("1111", "1111", "2222", "3333"), "1111:E130 1111:RUNAWAY 2222:E130 3333:RUNAWAY"},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := limitedSession("Limit "+tt.name, tt.config)
+			for i, call := range tt.calls {
+				got := summary(limitSignalsAt(s, call.signals, "raw", start.Add(call.at)))
+				if got != call.want {
+					t.Errorf("call %d: got %q, want %q", i, got, call.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFloodSignalText(t *testing.T) {
+	s := limitedSession("Limit text", RateLimitConfig{PerAccount: 1})
+	start := time.Date(2024, 2, 21, 1, 0, 0, 0, time.UTC)
+	limitSignalsAt(s, alarms("1234", "1234", "1234", "1234"), "raw", start)
+	signals := limitSignalsAt(s, alarms("1234"), "raw", start.Add(3*time.Minute))
+	end := signals[0].(model.AlarmSignal)
+	if end.EventCode != runawayEndEvent || end.Type != "runaway" || !strings.Contains(end.Text, "3 signals were suppressed") ||
+		end.ReceiverId != "4" || end.RawSignal != "raw" {
+		t.Errorf("flood end signal %+v", end)
+	}
+}
+
+func TestFloodWindowExpire(t *testing.T) {
+	start := time.Date(2024, 2, 21, 1, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		name  string
+		w     floodWindow
+		at    time.Duration
+		ended int
+	}{
+		{"no flood", floodWindow{start: start, count: 1}, 3 * time.Minute, 0},
+		{"window not over", floodWindow{start: start, count: 1, suppressed: 2, flooding: true}, 59 * time.Second, 0},
+		{"window within limit", floodWindow{start: start, count: 1, suppressed: 2, flooding: true}, time.Minute, 2},
+		{"over limit, next window not over", floodWindow{start: start, count: 5, suppressed: 3, flooding: true}, 119 * time.Second, 0},
+		{"over limit, then a quiet window", floodWindow{start: start, count: 5, suppressed: 3, flooding: true}, 2 * time.Minute, 3},
+	} {
+		w := tt.w
+		if ended := w.expire(start.Add(tt.at), time.Minute, 2); ended != tt.ended {
+			t.Errorf("%s: ended %d, want %d", tt.name, ended, tt.ended)
+		}
+		if w.flooding != (tt.ended == 0 && tt.w.flooding) {
+			t.Errorf("%s: still flooding %t", tt.name, w.flooding)
+		}
+	}
+}
+
+func TestQuietFloodEnds(t *testing.T) {
+	start := time.Date(2024, 2, 21, 1, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		name   string
+		config RateLimitConfig
+		want   string
+	}{
+		{"per account", RateLimitConfig{PerAccount: 2}, "Account 1234 calmed down, 2 signals were suppressed"},
+		{"per connection", RateLimitConfig{PerConnection: 2}, "Connection 10.0.0.9:4000 calmed down, 2 signals were suppressed"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := limitedSession("Quiet "+tt.name, tt.config)
+			if got := summary(limitSignalsAt(s, alarms("1234", "1234", "1234", "1234"), "raw", start)); got != "1234:E130 1234:E130 1234:RUNAWAY" {
+				t.Fatalf("flood %q", got)
+			}
+			if ends := s.limiter.expire(start.Add(119 * time.Second)); len(ends) != 0 {
+				t.Errorf("ended before a quiet window: %q", summary(ends))
+			}
+
+			// No signal follows, the tick ends the flood after a quiet window
+			at := start.Add(2 * time.Minute)
+			ends := s.limiter.expire(at)
+			if len(ends) != 1 {
+				t.Fatalf("flood end signals %q", summary(ends))
+			}
+			end := ends[0].(model.AlarmSignal)
+			if end.EventCode != runawayEndEvent || end.SideNo != "1234" || end.Text != tt.want || !end.SignalDateTime.Equal(at) || end.RawSignal != "" {
+				t.Errorf("flood end signal %+v", end)
+			}
+			if ends := s.limiter.expire(start.Add(3 * time.Minute)); len(ends) != 0 {
+				t.Errorf("ended twice: %q", summary(ends))
+			}
+			// The next signal starts afresh instead of ending the flood again
+			if got := summary(limitSignalsAt(s, alarms("1234"), "raw", start.Add(4*time.Minute))); got != "1234:E130" {
+				t.Errorf("after the flood %q", got)
+			}
+		})
+	}
+}
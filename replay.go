@@ -0,0 +1,201 @@
+package main
+
+import (
+	"agent/archive"
+	"agent/model"
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// replayOptions holds the flags of the replay command.
+type replayOptions struct {
+	serviceType string
+	service     string
+	account     string
+	from, to    time.Time
+	publish     bool
+}
+
+// runReplay re-runs archived or plain-text frames through the current parsers,
+// e.g. after a regex fix in protocol/. Without -publish it only prints what
+// would be published.
+//
+//	agent replay [-type T | -service NAME] [-from T] [-to T] [-account A] [-publish] FILE...
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	configPath := flags.String("config", "conf.yaml", "configuration file")
+	serviceType := flags.String("type", "", "parser to use, e.g. SURGUARD; defaults to the type recorded in the archive")
+	service := flags.String("service", "", "only replay frames of this service, and use its type and id")
+	account := flags.String("account", "", "only replay signals of this account")
+	from := flags.String("from", "", "only replay frames received at or after this RFC 3339 time")
+	to := flags.String("to", "", "only replay frames received before this RFC 3339 time")
+	publish := flags.Bool("publish", false, "publish the signals, marked as replays and dated when received, instead of printing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("replay: no input files")
+	}
+
+	opts := replayOptions{serviceType: *serviceType, service: *service, account: *account, publish: *publish}
+	var err error
+	if opts.from, err = parseTimeFlag(*from); err != nil {
+		return fmt.Errorf("replay: -from: %w", err)
+	}
+	if opts.to, err = parseTimeFlag(*to); err != nil {
+		return fmt.Errorf("replay: -to: %w", err)
+	}
+
+	// The configuration is optional when the type is given on the command line
+	if err := loadConfig(*configPath); err != nil && (opts.service != "" || opts.publish) {
+		return err
+	}
+	if opts.service != "" {
+		svc, exists := findService(opts.service)
+		if !exists {
+			return fmt.Errorf("replay: no service named %s in %s", opts.service, *configPath)
+		}
+		if opts.serviceType == "" {
+			opts.serviceType = svc.Type
+		}
+	}
+
+	if opts.publish {
+		if pubsubClient, err = initPubSubClient("bulutalarm"); err != nil {
+			return err
+		}
+		defer pubsubClient.Close()
+	}
+
+	for _, path := range flags.Args() {
+		if archive.IsArchive(path) {
+			err = archive.ReadFile(path, func(record archive.Record) error {
+				return replayRecord(record, opts)
+			})
+		} else {
+			err = replayTextFile(path, opts)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseTimeFlag(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func replayRecord(record archive.Record, opts replayOptions) error {
+	if record.Direction != archive.Received {
+		return nil
+	}
+	if opts.service != "" && record.Service != opts.service {
+		return nil
+	}
+	if !opts.from.IsZero() && record.Time.Before(opts.from) {
+		return nil
+	}
+	if !opts.to.IsZero() && !record.Time.Before(opts.to) {
+		return nil
+	}
+
+	serviceType := opts.serviceType
+	if serviceType == "" {
+		serviceType = record.Type
+	}
+	return replayFrame(record.Frame, serviceType, record.Service, record.Time, opts)
+}
+
+// replayTextFile replays a file with one raw frame per line. Lines carry no
+// receive time, so -from and -to do not apply.
+func replayTextFile(path string, opts replayOptions) error {
+	if opts.serviceType == "" {
+		return fmt.Errorf("replay: %s is not an archive, -type or -service is required", path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		frame := strings.TrimRight(scanner.Text(), "\r")
+		if frame == "" {
+			continue
+		}
+		if err := replayFrame([]byte(frame), opts.serviceType, opts.service, time.Time{}, opts); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func replayFrame(frame []byte, serviceType, serviceName string, received time.Time, opts replayOptions) error {
+	service, _ := findService(serviceName)
+	service.Type = serviceType
+
+	event, ack, err := parseFrame(frame, service)
+	if err != nil {
+		fmt.Printf("Error parsing %q: %v\n", frame, err)
+		return nil
+	}
+
+	var selected []interface{}
+	for _, e := range event {
+		if opts.account == "" || model.SignalAccount(e) == opts.account {
+			selected = append(selected, asReplay(e, received))
+		}
+	}
+	if len(selected) == 0 {
+		return nil
+	}
+
+	if opts.publish {
+		attributes := map[string]string{"replay": "true"}
+		if !received.IsZero() {
+			attributes["receivedAt"] = received.Format(time.RFC3339Nano)
+		}
+		return publishSignals(selected, attributes)
+	}
+
+	output, err := json.MarshalIndent(map[string]interface{}{
+		"frame":   string(frame),
+		"signals": selected,
+		"ack":     ack,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(output))
+	return nil
+}
+
+// asReplay marks a replayed signal in its payload and dates it when the frame
+// was first received, so consumers do not take it for a live event.
+func asReplay(signal interface{}, received time.Time) interface{} {
+	switch s := signal.(type) {
+	case model.AlarmSignal:
+		s.Replay = true
+		if !received.IsZero() {
+			s.SignalDateTime = received
+		}
+		return s
+	case model.PhoneSignal:
+		s.Replay = true
+		return s
+	case model.PingSignal:
+		s.Replay = true
+		return s
+	}
+	return signal
+}
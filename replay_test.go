@@ -0,0 +1,28 @@
+package main
+
+import (
+	"agent/model"
+	"testing"
+	"time"
+)
+
+func TestAsReplay(t *testing.T) {
+	received := time.Date(2024, 2, 21, 1, 7, 45, 0, time.UTC)
+	live := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+
+	alarm := asReplay(model.AlarmSignal{SideNo: "1234", EventCode: "E130", SignalDateTime: live}, received).(model.AlarmSignal)
+	if !alarm.Replay || !alarm.SignalDateTime.Equal(received) {
+		t.Errorf("archived alarm %+v", alarm)
+	}
+	// Plain-text frames carry no receive time
+	alarm = asReplay(model.AlarmSignal{SideNo: "1234", SignalDateTime: live}, time.Time{}).(model.AlarmSignal)
+	if !alarm.Replay || !alarm.SignalDateTime.Equal(live) {
+		t.Errorf("text alarm %+v", alarm)
+	}
+	if ping := asReplay(model.PingSignal{SideNo: "1234"}, received).(model.PingSignal); !ping.Replay {
+		t.Errorf("ping %+v", ping)
+	}
+	if phone := asReplay(model.PhoneSignal{SideNo: "1234"}, received).(model.PhoneSignal); !phone.Replay {
+		t.Errorf("phone %+v", phone)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"agent/protocol"
+	"bufio"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cidToSia maps the Contact ID events the simulator sends to their SIA codes,
+// for the SIA-DCS frames.
+var cidToSia = map[string]string{
+	"E110": "FA", "R110": "FH",
+	"E120": "PA", "R120": "PH",
+	"E130": "BA", "R130": "BH",
+	"E137": "TA", "R137": "TR",
+	"E301": "AT", "R301": "AR",
+	"E302": "YT", "R302": "YR",
+	"E401": "OP", "R401": "CL",
+	"E602": "RP",
+}
+
+// simEvent is one entry of the -mix flag.
+type simEvent struct {
+	code   string // Contact ID qualifier and event, e.g. E130
+	weight int
+}
+
+// simOptions holds the flags of the simulate command.
+type simOptions struct {
+	service    ServiceConfig
+	addr       string
+	accounts   []string
+	mix        []simEvent
+	format     string
+	encrypt    bool
+	zones      int
+	count      int
+	rate       float64
+	ackTimeout time.Duration
+}
+
+// simStats collects the results of all simulated connections.
+type simStats struct {
+	sent, acked, badAck, noAck atomic.Int64
+	latency                    atomic.Int64 // Sum of ACK round trips in nanoseconds
+}
+
+// runSimulate connects to a configured service like a panel or receiver would,
+// sends generated frames with the right framing and checks every ACK.
+//
+//	agent simulate -service NAME [-host H] [-accounts A,B] [-mix E130:5,R130:5] [-rate N] [-count N] [-concurrency N]
+func runSimulate(args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	configPath := flags.String("config", "conf.yaml", "configuration file")
+	serviceName := flags.String("service", "", "service to send to, its type, port, endChar and key are used")
+	host := flags.String("host", "localhost", "host the service listens on")
+	accounts := flags.String("accounts", "1234", "comma separated accounts to send as")
+	mix := flags.String("mix", "E130:5,R130:5,E602:1", "Contact ID events with weights, code:weight,...")
+	format := flags.String("format", "cid", "DC-09 message type: cid, sia or null")
+	encrypt := flags.Bool("encrypt", false, "send encrypted DC-09 with the service key")
+	zones := flags.Int("zones", 8, "zones are picked from 1 to this number")
+	count := flags.Int("count", 10, "frames per connection")
+	rate := flags.Float64("rate", 1, "frames per second per connection, 0 sends as fast as ACKs come")
+	concurrency := flags.Int("concurrency", 1, "parallel connections")
+	ackTimeout := flags.Duration("ackTimeout", 5*time.Second, "how long to wait for each ACK")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := loadConfig(*configPath); err != nil {
+		return err
+	}
+	service, exists := findService(*serviceName)
+	if !exists {
+		return fmt.Errorf("simulate: no service named %q in %s", *serviceName, *configPath)
+	}
+	if *encrypt && service.Key == "" {
+		return fmt.Errorf("simulate: service %s has no key to encrypt with", service.Name)
+	}
+
+	opts := simOptions{
+		service:    service,
+		addr:       net.JoinHostPort(*host, strconv.Itoa(service.Port)),
+		format:     *format,
+		encrypt:    *encrypt,
+		zones:      max(*zones, 1),
+		count:      *count,
+		rate:       *rate,
+		ackTimeout: *ackTimeout,
+	}
+	for _, account := range strings.Split(*accounts, ",") {
+		if account = strings.TrimSpace(account); account != "" {
+			opts.accounts = append(opts.accounts, account)
+		}
+	}
+	if len(opts.accounts) == 0 {
+		return fmt.Errorf("simulate: no accounts")
+	}
+	var err error
+	if opts.mix, err = parseMix(*mix); err != nil {
+		return fmt.Errorf("simulate: -mix: %w", err)
+	}
+
+	stats := &simStats{}
+	started := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			if err := simulateConnection(opts, worker, stats); err != nil {
+				fmt.Printf("Worker %d: %v\n", worker, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	elapsed := time.Since(started)
+	fmt.Printf("Sent %d frames in %s: %d acked, %d wrong ACK, %d without ACK\n",
+		stats.sent.Load(), elapsed.Round(time.Millisecond), stats.acked.Load(), stats.badAck.Load(), stats.noAck.Load())
+	if acked := stats.acked.Load(); acked > 0 {
+		fmt.Printf("Average ACK round trip %s, %.1f frames/s\n",
+			time.Duration(stats.latency.Load()/acked).Round(time.Microsecond), float64(stats.sent.Load())/elapsed.Seconds())
+	}
+	if stats.badAck.Load() > 0 || stats.noAck.Load() > 0 {
+		return fmt.Errorf("simulate: %d frames were not acknowledged correctly", stats.badAck.Load()+stats.noAck.Load())
+	}
+	return nil
+}
+
+func parseMix(mix string) ([]simEvent, error) {
+	var events []simEvent
+	for _, entry := range strings.Split(mix, ",") {
+		code, weight, found := strings.Cut(strings.TrimSpace(entry), ":")
+		w := 1
+		if found {
+			var err error
+			if w, err = strconv.Atoi(weight); err != nil || w < 1 {
+				return nil, fmt.Errorf("bad weight in %q", entry)
+			}
+		}
+		if len(code) != 4 || (code[0] != 'E' && code[0] != 'R') {
+			return nil, fmt.Errorf("bad event %q, expected e.g. E130", code)
+		}
+		events = append(events, simEvent{code: code, weight: w})
+	}
+	return events, nil
+}
+
+func (o simOptions) pickEvent(rng *rand.Rand) string {
+	total := 0
+	for _, e := range o.mix {
+		total += e.weight
+	}
+	n := rng.Intn(total)
+	for _, e := range o.mix {
+		if n -= e.weight; n < 0 {
+			return e.code
+		}
+	}
+	return o.mix[0].code
+}
+
+func simulateConnection(opts simOptions, worker int, stats *simStats) error {
+	conn, err := net.DialTimeout("tcp", opts.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(worker)))
+
+	var interval time.Duration
+	if opts.rate > 0 {
+		interval = time.Duration(float64(time.Second) / opts.rate)
+	}
+
+	for i := 0; i < opts.count; i++ {
+		next := time.Now().Add(interval)
+		account := opts.accounts[rng.Intn(len(opts.accounts))]
+		sequence := (worker*opts.count + i) % 10000
+
+		frame, expect, err := opts.frame(account, opts.pickEvent(rng), 1+rng.Intn(opts.zones), sequence)
+		if err != nil {
+			return err
+		}
+
+		sent := time.Now()
+		if _, err := conn.Write([]byte(frame)); err != nil {
+			return err
+		}
+		stats.sent.Add(1)
+
+		ack, err := readAck(conn, r, opts, sent.Add(opts.ackTimeout))
+		switch {
+		case err != nil:
+			stats.noAck.Add(1)
+			fmt.Printf("Worker %d: no ACK for %q: %v\n", worker, frame, err)
+			return err
+		case !expect(ack):
+			stats.badAck.Add(1)
+			fmt.Printf("Worker %d: unexpected ACK %q for %q\n", worker, ack, frame)
+		default:
+			stats.acked.Add(1)
+			stats.latency.Add(int64(time.Since(sent)))
+		}
+
+		time.Sleep(time.Until(next))
+	}
+	return nil
+}
+
+// readAck reads a single ACK byte, or a whole DC-09 or DC-07 ACK message up to its CR.
+func readAck(conn net.Conn, r *bufio.Reader, opts simOptions, deadline time.Time) (string, error) {
+	conn.SetReadDeadline(deadline)
+	if !isDc09Ack(opts) && opts.service.Type != "DC07" {
+		b, err := r.ReadByte()
+		return string([]byte{b}), err
+	}
+	return r.ReadString('\r')
+}
+
+func isDc09Ack(opts simOptions) bool {
+	profile, isDc09 := protocol.Dc09ProfileFor(opts.service.Type, opts.service.Profile)
+	return isDc09 && !profile.ByteAck
+}
+
+// frame builds one frame, including the service delimiter, and a check for
+// the ACK the receiver must answer with.
+func (o simOptions) frame(account, code string, zone, sequence int) (string, func(string) bool, error) {
+	end := string([]byte{o.service.EndChar})
+	qualifier := "1"
+	if code[0] == 'R' {
+		qualifier = "3"
+	}
+	partition := "01"
+	zoneText := fmt.Sprintf("%03d", zone)
+	byteAck := func(ack string) bool { return ack == "\x06" }
+
+	switch o.service.Type {
+	case "SURGUARD":
+		// 5RRLLL 18AAAAQEEEGGCCC, Q as E/R like the MLR2 prints it
+		return fmt.Sprintf("501001 18%s%s%s%s", account, code, partition, zoneText) + end, byteAck, nil
+	case "ADEMCO":
+		// 5AAAA18QEEEGGCCC
+		return fmt.Sprintf("5%s18%s%s%s%s", account, qualifier, code[1:], partition, zoneText) + end, byteAck, nil
+	case "OH":
+		// SRrrrrLllll    AAAAAA18    [QEEE GG CCC]
+		return fmt.Sprintf("SR0001L0001    %06s18    [%s%s %s %s]", account, qualifier, code[1:], partition, zoneText) + end, byteAck, nil
+	case "DC07":
+		data := fmt.Sprintf("#%s|%s%s %s %s", account, qualifier, code[1:], partition, zoneText)
+		frame := protocol.Dc07Message("ADM-CID", sequence+1, 1, 1, account, data)
+		if o.service.EndChar != '\r' {
+			frame += end
+		}
+		seq := fmt.Sprintf("%04d", sequence%9999+1)
+		return frame, func(ack string) bool { return ack == protocol.Dc07Ack(seq) }, nil
+	case "RADIONICS":
+		// CRRL AAAA QEEE GG CCC
+		return fmt.Sprintf("C011 %s %s%s %s %s", account, qualifier, code[1:], partition, zoneText) + end, byteAck, nil
+	}
+
+	profile, isDc09 := protocol.Dc09ProfileFor(o.service.Type, o.service.Profile)
+	if !isDc09 {
+		return "", nil, fmt.Errorf("simulating service type %s is not supported", o.service.Type)
+	}
+	switch o.format {
+	case "sia":
+		sia, exists := cidToSia[code]
+		if !exists {
+			sia = "UX"
+		}
+		data := fmt.Sprintf("#%s|Nri%d/%s%s]", account, 1, sia, zoneText)
+		return o.dc09Frame("SIA-DCS", account, data, sequence, end)
+	case "null":
+		return o.dc09Frame("NULL", account, "]", sequence, end)
+	}
+	// Contact ID with the quirks of the profile, e.g. Teknim's "18" and
+	// Fonri's zone name block
+	data := fmt.Sprintf("#%s|%s%s%s %s %s]", account, profile.CidPrefix, qualifier, code[1:], partition, zoneText)
+	if profile.ZoneNameBlock {
+		data += fmt.Sprintf("[IZone %d]", zone)
+	}
+	return o.dc09Frame("ADM-CID", account, data, sequence, end)
+}
+
+// dc09Frame wraps data in a DC-09 message with CRC, length and time stamp,
+// encrypted when asked, terminated by CR and the service delimiter.
+func (o simOptions) dc09Frame(messageType, account, data string, sequence int, end string) (string, func(string) bool, error) {
+	seq := fmt.Sprintf("%04d", sequence)
+	body := fmt.Sprintf(`"%s"%sR0L0#%s[%s%s`, messageType, seq, account, data, protocol.Dc09Timestamp(time.Now()))
+
+	var err error
+	if o.encrypt {
+		if body, err = protocol.EncryptDc09(body, o.service.Key); err != nil {
+			return "", nil, err
+		}
+	}
+	frame := protocol.Dc09Frame(body) + "\r" + end
+
+	if !isDc09Ack(o) {
+		return frame, func(ack string) bool { return ack == "\x06" }, nil
+	}
+	ackType := `"ACK"`
+	if o.encrypt {
+		ackType = `"*ACK"`
+	}
+	return frame, func(ack string) bool {
+		return strings.Contains(ack, ackType+seq) && strings.Contains(ack, "#"+account+"[")
+	}, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"agent/protocol"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestSimulatedFramesParse sends every frame the simulator can build through
+// the receiver's parseFrame, and checks the simulator accepts the ACK it gets.
+func TestSimulatedFramesParse(t *testing.T) {
+	const key = "000102030405060708090A0B0C0D0E0F"
+	type simCase struct {
+		service ServiceConfig
+		format  string
+		encrypt bool
+	}
+	cases := []simCase{
+		{service: ServiceConfig{Type: "SURGUARD", EndChar: 0x14}},
+		{service: ServiceConfig{Type: "ADEMCO", EndChar: 0x14}},
+		{service: ServiceConfig{Type: "OH", EndChar: 0x14}},
+		{service: ServiceConfig{Type: "RADIONICS", EndChar: 0x14}},
+		{service: ServiceConfig{Type: "DC07", EndChar: '\r'}},
+		{service: ServiceConfig{Type: "DC07", EndChar: '\n'}},
+		{service: ServiceConfig{Type: "TEKNIM", EndChar: '\n'}, format: "cid"},
+		{service: ServiceConfig{Type: "FONRI", EndChar: '\n'}, format: "cid"},
+	}
+	for _, profile := range protocol.Dc09Profiles() {
+		for _, format := range []string{"cid", "sia", "null"} {
+			cases = append(cases, simCase{service: ServiceConfig{Type: "DC09", Profile: profile, EndChar: '\n'}, format: format})
+		}
+	}
+	for _, format := range []string{"cid", "sia", "null"} {
+		cases = append(cases, simCase{service: ServiceConfig{Type: "DC09", EndChar: '\n', Key: key}, format: format, encrypt: true})
+	}
+
+	for i, c := range cases {
+		c.service.Id = 7
+		c.service.Name = fmt.Sprintf("Simulated %d", i)
+		name := strings.Trim(fmt.Sprintf("%s/%s/%s", c.service.Type, c.service.Profile, c.format), "/")
+		if c.encrypt {
+			name += "/encrypted"
+		}
+		opts := simOptions{service: c.service, format: c.format, encrypt: c.encrypt}
+
+		for sequence, code := range []string{"E130", "R130", "E602"} {
+			frame, expect, err := opts.frame("1234", code, 3, sequence)
+			if err != nil {
+				t.Errorf("%s %s: %v", name, code, err)
+				continue
+			}
+			// The frame reader hands parseFrame the frame without its delimiter
+			data, found := strings.CutSuffix(frame, string([]byte{c.service.EndChar}))
+			if !found {
+				t.Errorf("%s %s: frame %q does not end with the delimiter", name, code, frame)
+				continue
+			}
+			if c.encrypt && !protocol.IsEncryptedDc09(data) {
+				t.Errorf("%s %s: frame %q is not encrypted", name, code, data)
+			}
+			signals, ack, err := parseFrame([]byte(data), c.service)
+			if err != nil {
+				t.Errorf("%s %s: %q: %v", name, code, data, err)
+				continue
+			}
+			if len(signals) == 0 {
+				t.Errorf("%s %s: %q parsed to no signals", name, code, data)
+			}
+			if !expect(ack) {
+				t.Errorf("%s %s: ACK %q for %q refused by the simulator", name, code, ack, data)
+			}
+		}
+	}
+}
+
+func TestParseMix(t *testing.T) {
+	events, err := parseMix("E130:5, R130, E602:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []simEvent{{"E130", 5}, {"R130", 1}, {"E602", 1}}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", events, want)
+	}
+	for _, mix := range []string{"130", "X130:1", "E130:0", "E130:x"} {
+		if _, err := parseMix(mix); err == nil {
+			t.Errorf("%q: no error", mix)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader hands out the TLS configuration of a listener. The certificate,
+// key and client CA files are checked on every handshake and re-read when their
+// modification time changes, so renewed certificates are picked up without a
+// restart. A failed reload keeps serving the previous configuration.
+type certReloader struct {
+	service ServiceConfig
+
+	mu     sync.Mutex
+	stamp  string
+	config *tls.Config
+}
+
+func newCertReloader(service ServiceConfig) (*certReloader, error) {
+	r := &certReloader{service: service}
+	stamp, err := r.fileStamp()
+	if err != nil {
+		return nil, err
+	}
+	if r.config, err = r.load(); err != nil {
+		return nil, err
+	}
+	r.stamp = stamp
+	return r, nil
+}
+
+// fileStamp summarizes the modification times of all files the configuration
+// is built from.
+func (r *certReloader) fileStamp() (string, error) {
+	stamp := ""
+	for _, path := range []string{r.service.TLS.CertFile, r.service.TLS.KeyFile, r.service.TLS.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		stamp += info.ModTime().Format(time.RFC3339Nano) + ";"
+	}
+	return stamp, nil
+}
+
+func (r *certReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.service.TLS.CertFile, r.service.TLS.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if r.service.TLS.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.service.TLS.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", r.service.TLS.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if r.service.TLS.RequireClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+func (r *certReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stamp, err := r.fileStamp()
+	if err != nil || stamp == r.stamp {
+		return r.config, nil
+	}
+	config, err := r.load()
+	if err != nil {
+		fmt.Printf("Error reloading TLS files for service %s, keeping the previous ones: %v\n", r.service.Name, err)
+		return r.config, nil
+	}
+	fmt.Printf("Reloaded TLS files for service %s\n", r.service.Name)
+	r.config = config
+	r.stamp = stamp
+	return config, nil
+}
+
+// newTLSListener wraps ln so every accepted connection is served over TLS.
+func newTLSListener(ln net.Listener, service ServiceConfig) (net.Listener, error) {
+	reloader, err := newCertReloader(service)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, &tls.Config{GetConfigForClient: reloader.configForClient}), nil
+}
+
+// clientAccounts completes the TLS handshake and returns the accounts the
+// client certificate may report. nil means any account; an error means the
+// client is not admitted at all.
+func clientAccounts(conn net.Conn, service ServiceConfig) (map[string]bool, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+	return certAccounts(tlsConn.ConnectionState().PeerCertificates, service)
+}
+
+// certAccounts returns the accounts a verified client certificate chain may
+// report, as clientAccounts does.
+func certAccounts(certs []*x509.Certificate, service ServiceConfig) (map[string]bool, error) {
+	if len(service.TLS.ClientAccounts) == 0 {
+		return nil, nil
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no client certificate")
+	}
+	cn := certs[0].Subject.CommonName
+	list, exists := service.TLS.ClientAccounts[cn]
+	if !exists {
+		return nil, fmt.Errorf("client certificate %q is not mapped to any account", cn)
+	}
+
+	accounts := make(map[string]bool, len(list))
+	for _, account := range list {
+		if account == "*" {
+			return nil, nil
+		}
+		accounts[account] = true
+	}
+	return accounts, nil
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"agent/archive"
+	"agent/model"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+HTTP services take signals POSTed as JSON by cloud-connected panels and
+mobile panic apps. The body is one object or an array of them; fields maps
+each signal field to the path of the JSON field holding it, fields left
+out are read from the JSON field of the same name.
+
+	POST /signals
+	Authorization: Bearer <token>
+
+	{"id": "9f1c", "panel": {"account": "1234"}, "event": "PA", "zone": 1,
+	 "gps": {"lat": 41.01512, "lon": 28.97953}, "time": "2024-02-21T01:07:45Z"}
+
+	fields: {sideNo: panel.account, eventCode: event, latitude: gps.lat, longitude: gps.lon, eventTime: time}
+
+The answer is a delivery status: 200 {"status":"delivered","signals":1},
+or "duplicate" when every object has an id that was already delivered,
+400 "rejected" for a body that does not map to signals, 403 "rejected" for
+an account the client certificate may not send for, and 503 "failed" when
+publishing failed and the sender should retry.
+*/
+
+const (
+	httpType           = "HTTP"
+	defaultWebhookPath = "/signals"
+	defaultWebhookBody = 64 << 10
+)
+
+// webhookFields are the signal fields a JSON field can be mapped to. id is
+// not published, it only recognizes a sender retrying a delivered request.
+var webhookFields = []string{
+	"id", "sideNo", "eventCode", "zone", "partNo", "zoneName", "userNo", "userName", "areaName",
+	"text", "eventTime", "latitude", "longitude", "mac", "verificationUrl", "siteName",
+}
+
+// Delivery statuses of an HTTP request.
+const (
+	webhookDelivered = "delivered"
+	webhookDuplicate = "duplicate"
+	webhookRejected  = "rejected"
+	webhookFailed    = "failed"
+)
+
+type webhookStatus struct {
+	Status     string `json:"status"`
+	Signals    int    `json:"signals,omitempty"`
+	Duplicates int    `json:"duplicates,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// checkWebhook validates the settings of an HTTP service.
+func checkWebhook(service ServiceConfig) error {
+	if service.Token == "" {
+		return errors.New("token is required for HTTP services")
+	}
+	if service.Path != "" && !strings.HasPrefix(service.Path, "/") {
+		return fmt.Errorf("path %q must start with /", service.Path)
+	}
+	return checkFields(service.Fields)
+}
+
+// checkFields validates a JSON field mapping.
+func checkFields(fields map[string]string) error {
+	for field := range fields {
+		if !containsString(webhookFields, field) {
+			return fmt.Errorf("unknown signal field %q in fields, expected one of %s", field, strings.Join(webhookFields, ", "))
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookItem is one object of a request body and the signal it maps to.
+type webhookItem struct {
+	id     string
+	signal model.AlarmSignal
+}
+
+// webhookItems maps a request body to signals. account is used for objects
+// without one, when the transport carries it.
+func webhookItems(data []byte, service ServiceConfig, account string) ([]webhookItem, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var body interface{}
+	if err := decoder.Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	objects, isArray := body.([]interface{})
+	if !isArray {
+		objects = []interface{}{body}
+	}
+	if len(objects) == 0 {
+		return nil, errors.New("no signals in the body")
+	}
+	items := make([]webhookItem, 0, len(objects))
+	for i, object := range objects {
+		if _, isObject := object.(map[string]interface{}); !isObject {
+			return nil, fmt.Errorf("signal %d is not a JSON object", i)
+		}
+		item, err := webhookItemOf(object, service, account)
+		if err != nil {
+			return nil, fmt.Errorf("signal %d: %w", i, err)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func webhookItemOf(object interface{}, service ServiceConfig, account string) (webhookItem, error) {
+	values := map[string]string{}
+	for _, field := range webhookFields {
+		path, mapped := service.Fields[field]
+		if !mapped {
+			path = field
+		}
+		if value, found := jsonLookup(object, path); found {
+			values[field] = value
+		}
+	}
+	if values["sideNo"] == "" {
+		values["sideNo"] = account
+	}
+	if values["sideNo"] == "" {
+		return webhookItem{}, errors.New("no account (sideNo)")
+	}
+	if values["eventCode"] == "" {
+		return webhookItem{}, errors.New("no event code (eventCode)")
+	}
+
+	raw, _ := json.Marshal(object)
+	signal := model.AlarmSignal{
+		Type:             "event",
+		SideNo:           values["sideNo"],
+		ReceiverId:       strconv.Itoa(service.Id),
+		PartNo:           values["partNo"],
+		MonitoringCenter: 1,
+		SignalDateTime:   time.Now(),
+		EventCode:        values["eventCode"],
+		Zone:             values["zone"],
+		ZoneName:         values["zoneName"],
+		UserNo:           values["userNo"],
+		UserName:         values["userName"],
+		AreaName:         values["areaName"],
+		Text:             values["text"],
+		MAC:              values["mac"],
+		VerificationURL:  values["verificationUrl"],
+		SiteName:         values["siteName"],
+		RawSignal:        string(raw),
+	}
+	if text, exists := values["eventTime"]; exists {
+		t, err := webhookTime(text)
+		if err != nil {
+			return webhookItem{}, err
+		}
+		signal.EventTime = &t
+	}
+	if _, exists := values["latitude"]; exists {
+		latitude, errLat := strconv.ParseFloat(values["latitude"], 64)
+		longitude, errLon := strconv.ParseFloat(values["longitude"], 64)
+		if errLat != nil || errLon != nil || latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+			return webhookItem{}, fmt.Errorf("invalid location %q, %q", values["latitude"], values["longitude"])
+		}
+		signal.Location = &model.Location{Latitude: latitude, Longitude: longitude}
+	}
+	return webhookItem{id: values["id"], signal: signal}, nil
+}
+
+// webhookTime reads an RFC 3339 time or Unix seconds.
+func webhookTime(text string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, text); err == nil {
+		return t, nil
+	}
+	seconds, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid eventTime %q, expected RFC 3339 or Unix seconds", text)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// jsonLookup follows a dot separated path of object keys and array indexes,
+// e.g. "zones.0.name", and returns the scalar it ends at as text.
+func jsonLookup(value interface{}, path string) (string, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return "", false
+			}
+			value = v[i]
+		default:
+			return "", false
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// webhookSignals maps a request body to signals; parseFrame uses it so
+// archived requests replay like any other frame, and MQTT for JSON payloads.
+func webhookSignals(data []byte, service ServiceConfig, account string) ([]interface{}, error) {
+	items, err := webhookItems(data, service, account)
+	if err != nil {
+		return nil, err
+	}
+	signals := make([]interface{}, len(items))
+	for i, item := range items {
+		signals[i] = item.signal
+	}
+	return signals, nil
+}
+
+// maxWebhookIds bounds the ids kept for duplicate detection; when full the
+// delivered ones are forgotten all at once.
+const maxWebhookIds = 10000
+
+var (
+	webhookIdsMu sync.Mutex
+	webhookIds   = map[string]bool{} // true once delivered, false while being published
+)
+
+// reserveWebhookId claims id for one request, false when it was delivered or
+// another request is publishing it. Checking and claiming under one lock
+// keeps two concurrent retries from both publishing.
+func reserveWebhookId(service ServiceConfig, id string) bool {
+	webhookIdsMu.Lock()
+	defer webhookIdsMu.Unlock()
+	key := service.Name + "/" + id
+	if _, taken := webhookIds[key]; taken {
+		return false
+	}
+	if len(webhookIds) >= maxWebhookIds {
+		for key, delivered := range webhookIds {
+			if delivered {
+				delete(webhookIds, key)
+			}
+		}
+	}
+	webhookIds[key] = false
+	return true
+}
+
+// rememberWebhookIds marks reserved ids delivered.
+func rememberWebhookIds(service ServiceConfig, ids []string) {
+	webhookIdsMu.Lock()
+	defer webhookIdsMu.Unlock()
+	for _, id := range ids {
+		webhookIds[service.Name+"/"+id] = true
+	}
+}
+
+// releaseWebhookIds gives up reserved ids whose publishing failed, so that
+// the retry is published.
+func releaseWebhookIds(service ServiceConfig, ids []string) {
+	webhookIdsMu.Lock()
+	defer webhookIdsMu.Unlock()
+	for _, id := range ids {
+		delete(webhookIds, service.Name+"/"+id)
+	}
+}
+
+type webhookHandler struct {
+	service ServiceConfig
+	path    string
+	publish func(s *session, signals []interface{}, rawSignal string) error
+}
+
+func newWebhookHandler(service ServiceConfig) *webhookHandler {
+	h := &webhookHandler{service: service, path: service.Path, publish: deliverSignals}
+	if h.path == "" {
+		h.path = defaultWebhookPath
+	}
+	return h
+}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	service := h.service
+	if r.URL.Path != h.path {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, hasToken := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !hasToken || subtle.ConstantTimeCompare([]byte(token), []byte(service.Token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	maxSize := service.MaxFrameSize
+	if maxSize <= 0 {
+		maxSize = defaultWebhookBody
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxSize)))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeWebhookStatus(w, http.StatusRequestEntityTooLarge, webhookStatus{Status: webhookRejected, Error: "body too large"})
+			return
+		}
+		writeWebhookStatus(w, http.StatusBadRequest, webhookStatus{Status: webhookRejected, Error: err.Error()})
+		return
+	}
+
+	s := &session{
+		id:      lastConnId.Add(1),
+		remote:  r.RemoteAddr,
+		service: service,
+		limiter: accountLimiterFor(service),
+	}
+	if r.TLS != nil {
+		if s.accounts, err = certAccounts(r.TLS.PeerCertificates, service); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	status, code := h.deliver(s, body)
+	writeWebhookStatus(w, code, status)
+}
+
+// deliver maps, publishes and archives one request body.
+func (h *webhookHandler) deliver(s *session, body []byte) (webhookStatus, int) {
+	fmt.Printf("Processing %s data from %s: %s\n", s.service.Type, s.remote, body)
+	items, err := webhookItems(body, s.service, "")
+	if err != nil {
+		s.archive(archive.Received, body, "unparsed")
+		return webhookStatus{Status: webhookRejected, Error: err.Error()}, http.StatusBadRequest
+	}
+
+	var signals []interface{}
+	var ids []string
+	duplicates := 0
+	for _, item := range items {
+		if item.id != "" && !reserveWebhookId(s.service, item.id) {
+			duplicates++
+			continue
+		}
+		signals = append(signals, item.signal)
+		if item.id != "" {
+			ids = append(ids, item.id)
+		}
+	}
+	if len(signals) == 0 {
+		s.archive(archive.Received, body, "no_signal")
+		return webhookStatus{Status: webhookDuplicate, Duplicates: duplicates}, http.StatusOK
+	}
+
+	if err := h.publish(s, signals, string(body)); err != nil {
+		releaseWebhookIds(s.service, ids)
+		s.archive(archive.Received, body, rxOutcome("", signals, err))
+		if errors.Is(err, errAccountNotAllowed) {
+			// Sending it again will not help
+			return webhookStatus{Status: webhookRejected, Error: err.Error()}, http.StatusForbidden
+		}
+		return webhookStatus{Status: webhookFailed, Error: err.Error()}, http.StatusServiceUnavailable
+	}
+	rememberWebhookIds(s.service, ids)
+	s.archive(archive.Received, body, "parsed")
+	return webhookStatus{Status: webhookDelivered, Signals: len(signals), Duplicates: duplicates}, http.StatusOK
+}
+
+func writeWebhookStatus(w http.ResponseWriter, code int, status webhookStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+// admittedListener applies the access lists and connection caps of a
+// service to the connections of an HTTP server.
+type admittedListener struct {
+	net.Listener
+	adm     *admission
+	service ServiceConfig
+}
+
+func (l admittedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		release, reason := l.adm.admit(conn.RemoteAddr())
+		if reason != "" {
+			fmt.Printf("Rejected connection from %s for service %s: %s\n", conn.RemoteAddr(), l.service.Name, reason)
+			countRejected(l.service, reason)
+			conn.Close()
+			continue
+		}
+		countAccepted(l.service)
+		return &admittedConn{Conn: conn, release: release}, nil
+	}
+}
+
+// admittedConn releases its admission slot when closed.
+type admittedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *admittedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+func startWebhook(service ServiceConfig) {
+	handler := newWebhookHandler(service)
+	serveHTTP(service, handler, handler.path)
+}
+
+// serveHTTP serves handler on the port of an HTTP-based listen service, with
+// its access lists, TLS and frame timeout.
+func serveHTTP(service ServiceConfig, handler http.Handler, path string) {
+	adm, err := newAdmission(service)
+	if err != nil {
+		fmt.Printf("Invalid access list for service %s: %v\n", service.Name, err)
+		return
+	}
+
+	tcp, err := net.Listen("tcp", fmt.Sprintf(":%d", service.Port))
+	if err != nil {
+		fmt.Printf("Error starting listener on port %d for service %s: %v\n", service.Port, service.Name, err)
+		return
+	}
+	// TLS outside the admission wrapper, so requests still see the *tls.Conn
+	var ln net.Listener = admittedListener{Listener: tcp, adm: adm, service: service}
+	if service.TLS.Enabled {
+		if ln, err = newTLSListener(ln, service); err != nil {
+			fmt.Printf("Error setting up TLS on port %d for service %s: %v\n", service.Port, service.Name, err)
+			return
+		}
+	}
+	defer ln.Close()
+
+	frameTimeout := service.FrameTimeout
+	if frameTimeout == 0 {
+		frameTimeout = defaultFrameTimeout
+	}
+	server := &http.Server{Handler: handler, IdleTimeout: service.IdleTimeout}
+	if frameTimeout > 0 {
+		server.ReadTimeout = frameTimeout
+	}
+	fmt.Printf("Listening on port %d for service %s with type %s on %s (TLS: %t)\n", service.Port, service.Name, service.Type, path, service.TLS.Enabled)
+	if err := server.Serve(ln); err != nil {
+		fmt.Printf("Error serving HTTP for service %s: %v\n", service.Name, err)
+	}
+}
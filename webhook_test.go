@@ -0,0 +1,204 @@
+package main
+
+import (
+	"agent/model"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var webhookService = ServiceConfig{
+	Name:  "Webhook",
+	Id:    7,
+	Type:  httpType,
+	Token: "s3cret",
+	Fields: map[string]string{
+		"sideNo":    "panel.account",
+		"eventCode": "event",
+		"latitude":  "gps.lat",
+		"longitude": "gps.lon",
+		"eventTime": "time",
+		"zoneName":  "zones.0.name",
+	},
+}
+
+func TestWebhookItems(t *testing.T) {
+	body := `[{"id": "9f1c", "panel": {"account": "1234"}, "event": "PA", "zone": 1, "gps": {"lat": 41.01512, "lon": 28.97953},
+		"time": "2024-02-21T01:07:45Z", "zones": [{"name": "Front door"}]},
+		{"panel": {"account": 5678}, "event": "E130", "partNo": "01", "time": 1708477665}]`
+	items, err := webhookItems([]byte(body), webhookService, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("%d items, want 2", len(items))
+	}
+
+	first := items[0].signal
+	wantTime := time.Date(2024, 2, 21, 1, 7, 45, 0, time.UTC)
+	if items[0].id != "9f1c" || first.SideNo != "1234" || first.EventCode != "PA" || first.Zone != "1" ||
+		first.ZoneName != "Front door" || first.ReceiverId != "7" || first.Type != "event" {
+		t.Errorf("first signal %+v", first)
+	}
+	if first.Location == nil || *first.Location != (model.Location{Latitude: 41.01512, Longitude: 28.97953}) {
+		t.Errorf("location %v", first.Location)
+	}
+	if first.EventTime == nil || !first.EventTime.Equal(wantTime) {
+		t.Errorf("event time %v, want %v", first.EventTime, wantTime)
+	}
+
+	second := items[1].signal
+	if second.SideNo != "5678" || second.PartNo != "01" || second.Location != nil || !second.EventTime.Equal(wantTime) {
+		t.Errorf("second signal %+v", second)
+	}
+}
+
+func TestWebhookItemsRejected(t *testing.T) {
+	for _, body := range []string{
+		``,
+		`{"panel": `,
+		`[]`,
+		`["PA"]`,
+		`{"event": "PA"}`,
+		`{"panel": {"account": "1234"}}`,
+		`{"panel": {"account": "1234"}, "event": "PA", "time": "yesterday"}`,
+		`{"panel": {"account": "1234"}, "event": "PA", "gps": {"lat": 91, "lon": 0}}`,
+		`{"panel": {"account": "1234"}, "event": "PA", "gps": {"lat": 41}}`,
+	} {
+		if items, err := webhookItems([]byte(body), webhookService, ""); err == nil {
+			t.Errorf("%q mapped to %+v, want an error", body, items)
+		}
+	}
+}
+
+func TestCheckWebhook(t *testing.T) {
+	if err := checkWebhook(webhookService); err != nil {
+		t.Errorf("valid service: %v", err)
+	}
+	for _, service := range []ServiceConfig{
+		{Type: httpType},
+		{Type: httpType, Token: "t", Path: "signals"},
+		{Type: httpType, Token: "t", Fields: map[string]string{"account": "panel.account"}},
+	} {
+		if checkWebhook(service) == nil {
+			t.Errorf("%+v accepted", service)
+		}
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	handler := newWebhookHandler(webhookService)
+	rememberWebhookIds(webhookService, []string{"9f1c"})
+	t.Cleanup(func() { clear(webhookIds) })
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		code   int
+		status string
+	}{
+		{"wrong path", http.MethodPost, "/other", "s3cret", `{}`, http.StatusNotFound, ""},
+		{"get", http.MethodGet, "/signals", "s3cret", ``, http.StatusMethodNotAllowed, ""},
+		{"no token", http.MethodPost, "/signals", "", `{}`, http.StatusUnauthorized, ""},
+		{"wrong token", http.MethodPost, "/signals", "guess", `{}`, http.StatusUnauthorized, ""},
+		{"bad body", http.MethodPost, "/signals", "s3cret", `{"event": "PA"}`, http.StatusBadRequest, webhookRejected},
+		{"too large", http.MethodPost, "/signals", "s3cret", `{"text": "` + strings.Repeat("x", defaultWebhookBody) + `"}`, http.StatusRequestEntityTooLarge, webhookRejected},
+		{"retried", http.MethodPost, "/signals", "s3cret", `{"id": "9f1c", "panel": {"account": "1234"}, "event": "PA"}`, http.StatusOK, webhookDuplicate},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("code %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			if tt.status == "" {
+				return
+			}
+			var status webhookStatus
+			if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || status.Status != tt.status {
+				t.Errorf("status %s, want %q", w.Body, tt.status)
+			}
+		})
+	}
+}
+
+func TestWebhookDeliverOutcomes(t *testing.T) {
+	t.Cleanup(func() { clear(webhookIds) })
+	body := []byte(`{"id": "a71e", "panel": {"account": "1234"}, "event": "PA"}`)
+	var publishErr error
+	published := 0
+	handler := newWebhookHandler(webhookService)
+	handler.publish = func(s *session, signals []interface{}, rawSignal string) error {
+		if publishErr != nil {
+			return publishErr
+		}
+		published++
+		return nil
+	}
+	s := &session{service: webhookService}
+
+	for _, tt := range []struct {
+		name   string
+		err    error
+		code   int
+		status string
+	}{
+		{"account refused", fmt.Errorf("%w: 1234", errAccountNotAllowed), http.StatusForbidden, webhookRejected},
+		{"publish failed", errors.New("pubsub down"), http.StatusServiceUnavailable, webhookFailed},
+		{"retry delivered", nil, http.StatusOK, webhookDelivered},
+		{"retry after delivery", nil, http.StatusOK, webhookDuplicate},
+	} {
+		publishErr = tt.err
+		if status, code := handler.deliver(s, body); code != tt.code || status.Status != tt.status {
+			t.Errorf("%s: %d %+v, want %d %s", tt.name, code, status, tt.code, tt.status)
+		}
+	}
+	if published != 1 {
+		t.Errorf("published %d times, want once", published)
+	}
+}
+
+func TestWebhookConcurrentRetries(t *testing.T) {
+	t.Cleanup(func() { clear(webhookIds) })
+	body := []byte(`{"id": "c0de", "panel": {"account": "1234"}, "event": "PA"}`)
+	var published atomic.Int32
+	publishing, release := make(chan struct{}), make(chan struct{})
+	handler := newWebhookHandler(webhookService)
+	handler.publish = func(s *session, signals []interface{}, rawSignal string) error {
+		published.Add(1)
+		close(publishing)
+		<-release
+		return nil
+	}
+
+	first := make(chan webhookStatus)
+	go func() {
+		status, _ := handler.deliver(&session{service: webhookService}, body)
+		first <- status
+	}()
+	<-publishing
+	// The retry arrives while the first request is still publishing
+	if status, code := handler.deliver(&session{service: webhookService}, body); code != http.StatusOK || status.Status != webhookDuplicate {
+		t.Errorf("concurrent retry: %d %+v, want duplicate", code, status)
+	}
+	close(release)
+	if status := <-first; status.Status != webhookDelivered {
+		t.Errorf("first request: %+v", status)
+	}
+	if n := published.Load(); n != 1 {
+		t.Errorf("published %d times, want once", n)
+	}
+}